@@ -0,0 +1,55 @@
+package lexer
+
+import "strings"
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+// Diagnostic is a problem found while lexing or parsing a program. Its
+// position belongs to the FileSet the program was lexed with, so Error
+// describes the problem without locating it, and Format looks up its file,
+// line and source text in the set.
+type Diagnostic interface {
+	error
+	Severity() Severity
+	// Pos is where the problem starts and Message describes it.
+	Pos() Pos
+	Message() string
+	Format(fset *FileSet) string
+}
+
+// Diagnostics collects every problem found in a single pass so they can be
+// reported together. It is returned as an error when it holds any errors.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	var msgs []string
+	for _, diag := range d {
+		msgs = append(msgs, diag.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (d Diagnostics) HasErrors() bool {
+	for _, diag := range d {
+		if diag.Severity() == SeverityError {
+			return true
+		}
+	}
+	return false
+}
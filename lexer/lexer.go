@@ -2,79 +2,118 @@ package lexer
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type Lexer struct {
+	file     *File
 	input    string
 	position int
-	line     int
-	column   int
+	pending  []Comment
+	comments []Comment
+	// start is where the token currently being read begins.
+	start Pos
+	// invalid records the first malformed UTF-8 sequence consumed while
+	// reading the current token.
+	invalid error
 }
 
 type LexerError struct {
-	Msg    string
-	line   int
-	column int
+	Msg string
+	pos Pos
 }
 
 func (e *LexerError) Error() string {
-	return fmt.Sprintf("[Line %d:%d]: %s", e.line, e.column, e.Msg)
+	return e.Msg
 }
 
-func (e *LexerError) Format(fileName string) string {
-	return fmt.Sprintf("[%s:%d:%d]: %s", fileName, e.line, e.column, e.Msg)
+func (e *LexerError) Format(fset *FileSet) string {
+	pos := fset.Position(e.pos)
+	msg := fmt.Sprintf("[%s:%d:%d]: %s", pos.Filename, pos.Line, pos.Column, e.Msg)
+	if excerpt := fset.File(e.pos).Underline(Span{Start: e.pos, End: e.pos}, e.pos); excerpt != "" {
+		msg += "\n" + excerpt
+	}
+	return msg
+}
+
+func (e *LexerError) Severity() Severity {
+	return SeverityError
+}
+
+func (e *LexerError) Pos() Pos {
+	return e.pos
 }
 
-func New(input string) *Lexer {
+func (e *LexerError) Message() string {
+	return e.Msg
+}
+
+// New returns a lexer for the source of file, whose tokens carry positions
+// in file.
+func New(file *File) *Lexer {
 	return &Lexer{
-		input:  input,
-		line:   1,
-		column: 1,
+		file:  file,
+		input: file.Source(),
 	}
 }
 
 func (l *Lexer) error(msg string) error {
-	return &LexerError{Msg: msg, line: l.line, column: l.column}
+	return &LexerError{Msg: msg, pos: l.pos()}
+}
+
+func (l *Lexer) errorAt(msg string, pos Pos) error {
+	return &LexerError{Msg: msg, pos: pos}
 }
 
 func (l *Lexer) newToken(t TokenType) Token {
-	return Token{
-		Type:    t,
-		Literal: t.String(),
-		Column:  l.column,
-		Line:    l.line,
-	}
+	return l.newTokenLiteral(t, t.String())
 }
 
 func (l *Lexer) newTokenLiteral(t TokenType, literal string) Token {
 	return Token{
 		Type:    t,
 		Literal: literal,
-		Column:  l.column,
-		Line:    l.line,
+		Start:   l.start,
+		End:     l.pos(),
 	}
 }
 
+func (l *Lexer) pos() Pos {
+	return l.file.Pos(l.position)
+}
+
 func (l *Lexer) peek() rune {
 	if l.position >= len(l.input) {
 		return 0
 	}
-	return rune(l.input[l.position])
+	r, _ := utf8.DecodeRuneInString(l.input[l.position:])
+	return r
+}
+
+func (l *Lexer) peekNext() rune {
+	if l.position >= len(l.input) {
+		return 0
+	}
+	_, size := utf8.DecodeRuneInString(l.input[l.position:])
+	if l.position+size >= len(l.input) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[l.position+size:])
+	return r
 }
 
 func (l *Lexer) next() rune {
 	if l.position >= len(l.input) {
 		return 0
 	}
-	char := rune(l.input[l.position])
-	if char == '\n' {
-		l.line++
-		l.column = 1
-	} else {
-		l.column++
+	char, size := utf8.DecodeRuneInString(l.input[l.position:])
+	if char == utf8.RuneError && size == 1 && l.invalid == nil {
+		l.invalid = l.error("invalid UTF-8 encoding")
 	}
-	l.position++
+	l.position += size
 	return char
 }
 
@@ -84,6 +123,70 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
+// skipTrivia skips whitespace and comments, queueing the comments so they
+// can be attached to the next token.
+func (l *Lexer) skipTrivia() error {
+	for {
+		l.skipWhitespace()
+		if l.peek() != '/' {
+			return nil
+		}
+		switch l.peekNext() {
+		case '/':
+			l.readLineComment()
+		case '*':
+			if err := l.readBlockComment(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *Lexer) readLineComment() {
+	start, pos := l.position, l.pos()
+	for l.peek() != '\n' && l.peek() != 0 {
+		l.next()
+	}
+	l.addComment(Comment{Text: l.input[start:l.position], Pos: pos})
+}
+
+func (l *Lexer) readBlockComment() error {
+	start, pos := l.position, l.pos()
+	l.next()
+	l.next()
+	depth := 1
+	for depth > 0 {
+		switch {
+		case l.peek() == 0:
+			return l.errorAt("unterminated block comment", pos)
+		case l.peek() == '/' && l.peekNext() == '*':
+			l.next()
+			l.next()
+			depth++
+		case l.peek() == '*' && l.peekNext() == '/':
+			l.next()
+			l.next()
+			depth--
+		default:
+			l.next()
+		}
+	}
+	l.addComment(Comment{Text: l.input[start:l.position], Block: true, Pos: pos})
+	return nil
+}
+
+func (l *Lexer) addComment(c Comment) {
+	l.pending = append(l.pending, c)
+	l.comments = append(l.comments, c)
+}
+
+// Comments returns every comment read so far, in source order.
+func (l *Lexer) Comments() []Comment {
+	return l.comments
+}
+
 func (l *Lexer) readLiteral() string {
 	l.skipWhitespace()
 	start := l.position
@@ -93,25 +196,313 @@ func (l *Lexer) readLiteral() string {
 	return string(l.input[start:l.position])
 }
 
-func (l *Lexer) readNumber() string {
+// readNumber reads a decimal literal with optional fraction and exponent,
+// or a 0x, 0b or 0o prefixed integer. Digits may be separated by single
+// underscores.
+func (l *Lexer) readNumber() (string, error) {
 	l.skipWhitespace()
+	pos := l.pos()
 	start := l.position
-	for unicode.IsDigit(l.peek()) {
+
+	if l.peek() == '0' {
+		var name string
+		var valid func(rune) bool
+		switch l.peekNext() {
+		case 'x', 'X':
+			name, valid = "hexadecimal", isHexDigit
+		case 'b', 'B':
+			name, valid = "binary", isBinaryDigit
+		case 'o', 'O':
+			name, valid = "octal", isOctalDigit
+		}
+		if valid != nil {
+			l.next()
+			l.next()
+			if !valid(l.peek()) {
+				return "", l.errorAt(fmt.Sprintf("%s literal has no digits", name), pos)
+			}
+			if err := l.readDigits(valid, pos); err != nil {
+				return "", err
+			}
+			if isAlphaNumeric(l.peek()) {
+				return "", l.error(fmt.Sprintf("invalid digit %q in %s literal", l.peek(), name))
+			}
+			return l.input[start:l.position], nil
+		}
+	}
+
+	if err := l.readDigits(isDigit, pos); err != nil {
+		return "", err
+	}
+	if l.peek() == '.' && isDigit(l.peekNext()) {
 		l.next()
+		if err := l.readDigits(isDigit, pos); err != nil {
+			return "", err
+		}
 	}
-	if l.peek() == '.' {
+	if l.peek() == 'e' || l.peek() == 'E' {
 		l.next()
-		for unicode.IsDigit(l.peek()) {
+		if l.peek() == '+' || l.peek() == '-' {
 			l.next()
 		}
+		if !isDigit(l.peek()) {
+			return "", l.errorAt("exponent has no digits", pos)
+		}
+		if err := l.readDigits(isDigit, pos); err != nil {
+			return "", err
+		}
+	}
+	if isAlphaNumeric(l.peek()) {
+		return "", l.error(fmt.Sprintf("invalid digit %q in number literal", l.peek()))
+	}
+	return l.input[start:l.position], nil
+}
+
+func (l *Lexer) readDigits(valid func(rune) bool, pos Pos) error {
+	for valid(l.peek()) || l.peek() == '_' {
+		if l.next() == '_' && !valid(l.peek()) {
+			return l.errorAt("'_' must separate successive digits", pos)
+		}
+	}
+	return nil
+}
+
+// readString reads a double quoted string, processing escape sequences and
+// lexing any ${...} interpolations into the token's Parts.
+func (l *Lexer) readString() (Token, error) {
+	start, pos := l.position, l.pos()
+	tokStart := l.start
+	l.next()
+
+	var parts []StringPart
+	var text strings.Builder
+	// A bad escape or interpolation is reported once the closing quote has
+	// been found, so the lexer resumes after the whole literal.
+	var partErr error
+	for {
+		if l.position >= len(l.input) {
+			return Token{}, l.errorAt("unterminated string literal", pos)
+		}
+		switch l.peek() {
+		case '"':
+			l.next()
+			// Interpolations lex nested tokens, which move l.start.
+			l.start = tokStart
+			if partErr != nil {
+				return l.newTokenLiteral(StringToken, text.String()), partErr
+			}
+			if parts == nil {
+				return l.newTokenLiteral(StringToken, text.String()), nil
+			}
+			if text.Len() > 0 {
+				parts = append(parts, StringPart{Text: text.String()})
+			}
+			tok := l.newTokenLiteral(StringToken, l.input[start:l.position])
+			tok.Parts = parts
+			return tok, nil
+		case '\\':
+			r, err := l.readEscape()
+			if err != nil && partErr == nil {
+				partErr = err
+			}
+			text.WriteRune(r)
+		case '$':
+			if l.peekNext() != '{' {
+				text.WriteRune(l.next())
+				continue
+			}
+			if text.Len() > 0 {
+				parts = append(parts, StringPart{Text: text.String()})
+				text.Reset()
+			}
+			tokens, err := l.readInterpolation()
+			if err != nil {
+				if l.position >= len(l.input) {
+					return Token{}, err
+				}
+				if partErr == nil {
+					partErr = err
+				}
+				continue
+			}
+			parts = append(parts, StringPart{Tokens: tokens})
+		default:
+			text.WriteRune(l.next())
+		}
 	}
-	return string(l.input[start:l.position])
+}
+
+func (l *Lexer) readEscape() (rune, error) {
+	pos := l.pos()
+	l.next()
+	c := l.next()
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case '0':
+		return 0, nil
+	case '\\', '"', '\'', '$':
+		return c, nil
+	case 'x':
+		return l.readHexEscape(2, pos)
+	case 'u':
+		if l.peek() != '{' {
+			return l.readHexEscape(4, pos)
+		}
+		l.next()
+		var digits strings.Builder
+		for l.peek() != '}' {
+			if !isHexDigit(l.peek()) || digits.Len() == 6 {
+				return 0, l.errorAt("invalid unicode escape sequence", pos)
+			}
+			digits.WriteRune(l.next())
+		}
+		l.next()
+		return l.decodeCodePoint(digits.String(), pos)
+	case 0:
+		return 0, l.errorAt("unterminated escape sequence", pos)
+	default:
+		return 0, l.errorAt(fmt.Sprintf("invalid escape sequence '\\%c'", c), pos)
+	}
+}
+
+func (l *Lexer) readHexEscape(n int, pos Pos) (rune, error) {
+	var digits strings.Builder
+	for range n {
+		if !isHexDigit(l.peek()) {
+			return 0, l.errorAt(fmt.Sprintf("escape sequence expects %d hex digits", n), pos)
+		}
+		digits.WriteRune(l.next())
+	}
+	return l.decodeCodePoint(digits.String(), pos)
+}
+
+func (l *Lexer) decodeCodePoint(digits string, pos Pos) (rune, error) {
+	code, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || digits == "" || !utf8.ValidRune(rune(code)) {
+		return 0, l.errorAt("invalid unicode code point", pos)
+	}
+	return rune(code), nil
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func isBinaryDigit(r rune) bool {
+	return r == '0' || r == '1'
+}
+
+func isOctalDigit(r rune) bool {
+	return '0' <= r && r <= '7'
+}
+
+func isAlphaNumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func isHexDigit(r rune) bool {
+	return isDigit(r) || ('a' <= r && r <= 'f') || ('A' <= r && r <= 'F')
+}
+
+// readInterpolation lexes the tokens of a ${...} block up to its matching
+// closing brace. Like Tokenize, it skips past bad tokens, reporting the
+// first once the block has been read, so that the string it is in can
+// still be read to its end.
+func (l *Lexer) readInterpolation() ([]Token, error) {
+	pos := l.pos()
+	l.next()
+	l.next()
+
+	var tokens []Token
+	var tokErr error
+	depth := 0
+	for {
+		start := l.position
+		tok, err := l.NextToken()
+		if err != nil {
+			if tokErr == nil {
+				tokErr = err
+			}
+			if l.position == start {
+				l.next()
+			}
+			if tok.Type == EOFToken {
+				continue
+			}
+		}
+		switch tok.Type {
+		case EOFToken:
+			if tokErr != nil {
+				return nil, tokErr
+			}
+			return nil, l.errorAt("unterminated string interpolation", pos)
+		case LeftBraceToken:
+			depth++
+		case RightBraceToken:
+			if depth == 0 {
+				if tokErr != nil {
+					return nil, tokErr
+				}
+				if len(tokens) == 0 {
+					return nil, l.errorAt("empty string interpolation", pos)
+				}
+				return tokens, nil
+			}
+			depth--
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+// readRawString reads a backtick delimited string. Raw strings may span
+// several lines and take their contents verbatim.
+func (l *Lexer) readRawString() (Token, error) {
+	pos := l.pos()
+	l.next()
+	start := l.position
+	for l.peek() != '`' {
+		if l.position >= len(l.input) {
+			return Token{}, l.errorAt("unterminated raw string literal", pos)
+		}
+		l.next()
+	}
+	literal := l.input[start:l.position]
+	l.next()
+	return l.newTokenLiteral(StringToken, literal), nil
 }
 
 func (l *Lexer) NextToken() (Token, error) {
-	l.skipWhitespace()
+	if err := l.skipTrivia(); err != nil {
+		return Token{}, err
+	}
+	if l.invalid != nil {
+		err := l.invalid
+		l.invalid = nil
+		return Token{}, err
+	}
+	l.start = l.pos()
+	tok, err := l.readToken()
+	if l.invalid != nil {
+		err, l.invalid = l.invalid, nil
+	}
+	if err != nil {
+		// tok may still hold a best-effort token, such as a string with a
+		// bad escape, so that callers can keep going.
+		return tok, err
+	}
+	tok.Comments = l.pending
+	l.pending = nil
+	return tok, nil
+}
+
+func (l *Lexer) readToken() (Token, error) {
 	if l.position >= len(l.input) {
-		return Token{Type: EOFToken}, nil
+		return l.newToken(EOFToken), nil
 	}
 
 	switch l.peek() {
@@ -122,6 +513,13 @@ func (l *Lexer) NextToken() (Token, error) {
 			return l.newToken(EqualToken), nil
 		}
 		return l.newToken(AssignToken), nil
+	case '.':
+		l.next()
+		if l.peek() == '.' {
+			l.next()
+			return l.newToken(DotDotToken), nil
+		}
+		return l.newToken(DotToken), nil
 	case ':':
 		l.next()
 		if l.peek() != '=' {
@@ -189,21 +587,9 @@ func (l *Lexer) NextToken() (Token, error) {
 		l.next()
 		return l.newToken(OrToken), nil
 	case '"':
-		l.next()
-		start := l.position
-		for l.peek() != '"' && l.peek() != 0 {
-			l.next()
-		}
-		if l.peek() == 0 {
-			return Token{}, l.error("unterminated string literal")
-		}
-		l.next()
-		return Token{
-			Type:    StringToken,
-			Literal: string(l.input[start : l.position-1]),
-			Column:  l.column,
-			Line:    l.line,
-		}, nil
+		return l.readString()
+	case '`':
+		return l.readRawString()
 	case '[':
 		l.next()
 		return l.newToken(LeftBracketToken), nil
@@ -236,25 +622,77 @@ func (l *Lexer) NextToken() (Token, error) {
 			return l.newToken(ReturnToken), nil
 		case "void":
 			return l.newToken(VoidToken), nil
+		case "break":
+			return l.newToken(BreakToken), nil
+		case "continue":
+			return l.newToken(ContinueToken), nil
+		case "for":
+			return l.newToken(ForToken), nil
+		case "struct":
+			return l.newToken(StructToken), nil
+		case "throw":
+			return l.newToken(ThrowToken), nil
+		case "try":
+			return l.newToken(TryToken), nil
+		case "catch":
+			return l.newToken(CatchToken), nil
+		case "finally":
+			return l.newToken(FinallyToken), nil
+		case "import":
+			return l.newToken(ImportToken), nil
+		case "export":
+			return l.newToken(ExportToken), nil
+		case "in":
+			return l.newToken(InToken), nil
 		default:
 			return l.newTokenLiteral(IdentToken, literal), nil
 		}
 	}
-	if unicode.IsDigit(l.peek()) {
-		literal := l.readNumber()
+	if isDigit(l.peek()) {
+		literal, err := l.readNumber()
+		if err != nil {
+			// Skip the rest of the malformed literal and stand in for it
+			// with a zero, so the parser stays in step with the source.
+			for isAlphaNumeric(l.peek()) {
+				l.next()
+			}
+			return l.newTokenLiteral(NumberToken, "0"), err
+		}
 		return l.newTokenLiteral(NumberToken, literal), nil
 	}
 
-	return Token{}, l.error("unexpected character")
+	err := l.error(fmt.Sprintf("unexpected character %q", l.peek()))
+	l.next()
+	return Token{}, err
 }
 
+// Tokenize reads the whole input. Lexical errors do not stop it: the
+// offending characters are skipped and every error is returned together
+// as Diagnostics alongside the tokens that could be read.
 func (l *Lexer) Tokenize() ([]Token, error) {
 	var tokens []Token
-	for currToken, err := l.NextToken(); currToken.Type != EOFToken; currToken, err = l.NextToken() {
+	var diags Diagnostics
+	for {
+		start := l.position
+		currToken, err := l.NextToken()
 		if err != nil {
-			return nil, err
+			diags = append(diags, err.(Diagnostic))
+			if l.position == start {
+				l.next()
+			}
+			l.pending = nil
+			if currToken.Type != EOFToken {
+				tokens = append(tokens, currToken)
+			}
+			continue
+		}
+		if currToken.Type == EOFToken {
+			break
 		}
 		tokens = append(tokens, currToken)
 	}
+	if len(diags) > 0 {
+		return tokens, diags
+	}
 	return tokens, nil
 }
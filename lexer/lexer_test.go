@@ -0,0 +1,160 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+// tokenize lexes src, which must be free of errors.
+func tokenize(t *testing.T, src string) (*FileSet, []Token) {
+	t.Helper()
+	fset := NewFileSet()
+	tokens, err := New(fset.AddFile("test.tiny", src)).Tokenize()
+	if err != nil {
+		t.Fatalf("lexing %q: %v", src, err)
+	}
+	return fset, tokens
+}
+
+// expectLexError checks that lexing src fails with an error containing
+// want.
+func expectLexError(t *testing.T, src, want string) {
+	t.Helper()
+	_, err := New(NewFileSet().AddFile("test.tiny", src)).Tokenize()
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("lexing %q: got error %v, want %q", src, err, want)
+	}
+}
+
+// literals returns the literal of each token.
+func literals(tokens []Token) []string {
+	var lits []string
+	for _, tok := range tokens {
+		lits = append(lits, tok.Literal)
+	}
+	return lits
+}
+
+func TestComments(t *testing.T) {
+	_, tokens := tokenize(t, `a // line
+b /* block /* nested */ still */ c /**/`)
+	if got := strings.Join(literals(tokens), " "); got != "a b c" {
+		t.Fatalf("got tokens %q, want a b c", got)
+	}
+	if c := tokens[1].Comments; len(c) != 1 || c[0].Text != "// line" || c[0].Block {
+		t.Errorf("comments before b = %+v, want the line comment", c)
+	}
+	if c := tokens[2].Comments; len(c) != 1 || c[0].Text != "/* block /* nested */ still */" || !c[0].Block {
+		t.Errorf("comments before c = %+v, want the nested block comment", c)
+	}
+	expectLexError(t, "a /* open /* */", "unterminated block comment")
+}
+
+func TestStrings(t *testing.T) {
+	_, tokens := tokenize(t, "\"a\\tb\\n\\\"q\\\" \\x41\\u{1F600}\" `raw\\n\nline`")
+	if want := "a\tb\n\"q\" A\U0001F600"; tokens[0].Literal != want {
+		t.Errorf("escaped string = %q, want %q", tokens[0].Literal, want)
+	}
+	if want := "raw\\n\nline"; tokens[1].Literal != want {
+		t.Errorf("raw string = %q, want %q", tokens[1].Literal, want)
+	}
+
+	_, tokens = tokenize(t, `"x = ${x + 1}!"`)
+	parts := tokens[0].Parts
+	if len(parts) != 3 || parts[0].Text != "x = " || parts[2].Text != "!" {
+		t.Fatalf("parts = %+v, want text, expression, text", parts)
+	}
+	if got := strings.Join(literals(parts[1].Tokens), " "); got != "x + 1" {
+		t.Errorf("interpolated tokens = %q, want x + 1", got)
+	}
+
+	expectLexError(t, `"bad \q"`, `invalid escape sequence '\q'`)
+	expectLexError(t, `"open`, "unterminated string")
+	expectLexError(t, `"${x`, "unterminated string interpolation")
+}
+
+func TestUnicode(t *testing.T) {
+	fset, tokens := tokenize(t, "let héllo := \"日本\"\n\tπ")
+	if got := strings.Join(literals(tokens), " "); got != "LET héllo := 日本 π" {
+		t.Fatalf("got tokens %q", got)
+	}
+	// Columns count runes, offsets bytes.
+	for _, tc := range []struct {
+		tok          int
+		line, column int
+		offset       int
+	}{
+		{1, 1, 5, 4},
+		{2, 1, 11, 11},
+		{3, 1, 14, 14},
+		{4, 2, 2, 24},
+	} {
+		pos := fset.Position(tokens[tc.tok].Start)
+		if pos.Line != tc.line || pos.Column != tc.column || pos.Offset != tc.offset {
+			t.Errorf("%q at %d:%d (offset %d), want %d:%d (offset %d)", tokens[tc.tok].Literal, pos.Line, pos.Column, pos.Offset, tc.line, tc.column, tc.offset)
+		}
+	}
+	expectLexError(t, "a \xff", "invalid UTF-8")
+}
+
+func TestNumbers(t *testing.T) {
+	_, tokens := tokenize(t, "0x1F 0b101 0o17 1_000 1.5e3 2E-2")
+	if got := strings.Join(literals(tokens), " "); got != "0x1F 0b101 0o17 1_000 1.5e3 2E-2" {
+		t.Errorf("got tokens %q", got)
+	}
+	expectLexError(t, "1__0", "'_' must separate successive digits")
+	expectLexError(t, "0x", "hexadecimal literal has no digits")
+	expectLexError(t, "1e", "exponent has no digits")
+}
+
+func TestUnderline(t *testing.T) {
+	f := NewFileSet().AddFile("test.tiny", "let x := \"é\" + 1\n\tfoo(bar)\n")
+	for _, tc := range []struct {
+		start, end, caret int
+		want              string
+	}{
+		{9, 13, 9, "    let x := \"é\" + 1\n             ^~~"},
+		{19, 27, 22, "    \tfoo(bar)\n    \t~~~^~~~~"},
+		// A span running onto the next line is underlined to the line end.
+		{0, 20, 0, "    let x := \"é\" + 1\n    ^~~~~~~~~~~~~~~~"},
+	} {
+		got := f.Underline(Span{Start: f.Pos(tc.start), End: f.Pos(tc.end)}, f.Pos(tc.caret))
+		if got != tc.want {
+			t.Errorf("Underline(%d, %d, %d) =\n%s\nwant\n%s", tc.start, tc.end, tc.caret, got, tc.want)
+		}
+	}
+}
+
+func TestFileSet(t *testing.T) {
+	fset := NewFileSet()
+	a := fset.AddFile("a.tiny", "let x := 1\nx")
+	b := fset.AddFile("b.tiny", "print(2)")
+	for _, tc := range []struct {
+		pos  Pos
+		file *File
+		want Position
+	}{
+		{a.Pos(0), a, Position{"a.tiny", 1, 1, 0}},
+		{a.Pos(11), a, Position{"a.tiny", 2, 1, 11}},
+		{a.Pos(a.Size()), a, Position{"a.tiny", 2, 2, 12}},
+		{b.Pos(6), b, Position{"b.tiny", 1, 7, 6}},
+		{NoPos, nil, Position{}},
+		{b.Pos(b.Size() + 1), nil, Position{}},
+	} {
+		if got := fset.File(tc.pos); got != tc.file {
+			t.Errorf("File(%d) = %v, want %v", tc.pos, got, tc.file)
+		}
+		if got := fset.Position(tc.pos); got != tc.want {
+			t.Errorf("Position(%d) = %+v, want %+v", tc.pos, got, tc.want)
+		}
+	}
+
+	// Tokens of each file carry positions in its own range.
+	tokens, err := New(b).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := fset.Position(tokens[2].Start); pos.Filename != "b.tiny" || pos.Column != 7 {
+		t.Errorf("token %q at %+v", tokens[2].Literal, pos)
+	}
+}
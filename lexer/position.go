@@ -0,0 +1,197 @@
+package lexer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Pos is a compact position in the files of a FileSet, which maps it back
+// to a file, line and column. Each file added to a set takes a range of
+// positions, one for each byte of its source and one for its end. The zero
+// Pos is NoPos, which is in no file.
+type Pos int
+
+const NoPos Pos = 0
+
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// Position is a Pos mapped back to its file. Line and Column are 1-based,
+// with columns counted in runes; Offset is the 0-based byte offset. The
+// Position of NoPos has a Line of 0.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+	Offset   int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// Span is the half-open range [Start, End) covered by a token or node.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+// File is a source file added to a FileSet.
+type File struct {
+	name string
+	base int
+	src  string
+	// lines holds the offset of the first byte of each line.
+	lines []int
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Source() string {
+	return f.src
+}
+
+// Base is the position of the first byte of f.
+func (f *File) Base() int {
+	return f.base
+}
+
+// Size is the length of f's source in bytes.
+func (f *File) Size() int {
+	return len(f.src)
+}
+
+// Pos returns the position of the byte at offset in f. An offset equal to
+// f's size is the end of the file.
+func (f *File) Pos(offset int) Pos {
+	return Pos(f.base + offset)
+}
+
+// Offset returns the byte offset of p, which must be a position in f.
+func (f *File) Offset(p Pos) int {
+	return int(p) - f.base
+}
+
+// Line returns the line of p, which must be a position in f.
+func (f *File) Line(p Pos) int {
+	return sort.SearchInts(f.lines, f.Offset(p)+1)
+}
+
+// Position returns p, which must be a position in f, mapped back to f.
+func (f *File) Position(p Pos) Position {
+	offset := f.Offset(p)
+	line := f.Line(p)
+	start := f.lines[line-1]
+	return Position{
+		Filename: f.name,
+		Line:     line,
+		Column:   utf8.RuneCountInString(f.src[start:offset]) + 1,
+		Offset:   offset,
+	}
+}
+
+// contains reports whether p is a position in f.
+func (f *File) contains(p Pos) bool {
+	return f != nil && f.base <= int(p) && int(p) <= f.base+len(f.src)
+}
+
+// Underline renders the source line holding span.Start with the span
+// marked underneath: '^' at caret and '~' over the rest of the range. A
+// span running past the end of its first line is underlined to the line
+// end. It returns "" unless span and caret are in f, which may be nil.
+func (f *File) Underline(span Span, caret Pos) string {
+	if !f.contains(span.Start) || !f.contains(span.End) || !f.contains(caret) {
+		return ""
+	}
+	start, end, at := f.Position(span.Start), f.Position(span.End), f.Position(caret)
+	errorLine := f.src[f.lines[start.Line-1]:]
+	if i := strings.IndexByte(errorLine, '\n'); i >= 0 {
+		errorLine = errorLine[:i]
+	}
+	errorLine = strings.TrimRight(errorLine, "\r")
+	runes := []rune(errorLine)
+
+	last := end.Column
+	if end.Line > start.Line {
+		last = len(runes) + 1
+	}
+	if last <= start.Column {
+		last = start.Column + 1
+	}
+
+	var marks strings.Builder
+	for col := 1; col < last; col++ {
+		switch {
+		case col < start.Column:
+			if col <= len(runes) && runes[col-1] == '\t' {
+				marks.WriteByte('\t')
+			} else {
+				marks.WriteByte(' ')
+			}
+		case col == at.Column && at.Line == start.Line:
+			marks.WriteByte('^')
+		case at.Line != start.Line && col == start.Column:
+			marks.WriteByte('^')
+		default:
+			marks.WriteByte('~')
+		}
+	}
+	return "    " + errorLine + "\n    " + marks.String()
+}
+
+// FileSet maps the positions of the files lexed for a program back to
+// their file, line and column. Files may be added to it concurrently.
+type FileSet struct {
+	mu    sync.RWMutex
+	base  int
+	files []*File
+}
+
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddFile adds a file with the given name and source to s, and returns it
+// so that it can be lexed.
+func (s *FileSet) AddFile(name, src string) *File {
+	f := &File{name: name, src: src, lines: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			f.lines = append(f.lines, i+1)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.base = s.base
+	s.base += len(src) + 1
+	s.files = append(s.files, f)
+	return f
+}
+
+// File returns the file holding p, or nil if there is none.
+func (s *FileSet) File(p Pos) *File {
+	if !p.IsValid() {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].base > int(p) }) - 1
+	if i < 0 || !s.files[i].contains(p) {
+		return nil
+	}
+	return s.files[i]
+}
+
+// Position returns p mapped back to its file, or the zero Position if p is
+// not in s.
+func (s *FileSet) Position(p Pos) Position {
+	if f := s.File(p); f != nil {
+		return f.Position(p)
+	}
+	return Position{}
+}
@@ -39,6 +39,19 @@ const (
 	FunctionToken
 	ReturnToken
 	VoidToken
+	BreakToken
+	ContinueToken
+	ForToken
+	InToken
+	DotDotToken
+	DotToken
+	StructToken
+	ThrowToken
+	TryToken
+	CatchToken
+	FinallyToken
+	ImportToken
+	ExportToken
 )
 
 func (t TokenType) String() string {
@@ -115,6 +128,32 @@ func (t TokenType) String() string {
 		return "RETURN"
 	case VoidToken:
 		return "VOID"
+	case BreakToken:
+		return "BREAK"
+	case ContinueToken:
+		return "CONTINUE"
+	case ForToken:
+		return "FOR"
+	case InToken:
+		return "IN"
+	case DotDotToken:
+		return ".."
+	case DotToken:
+		return "."
+	case StructToken:
+		return "STRUCT"
+	case ThrowToken:
+		return "THROW"
+	case TryToken:
+		return "TRY"
+	case CatchToken:
+		return "CATCH"
+	case FinallyToken:
+		return "FINALLY"
+	case ImportToken:
+		return "IMPORT"
+	case ExportToken:
+		return "EXPORT"
 	default:
 		return "UNKNOWN"
 	}
@@ -123,6 +162,37 @@ func (t TokenType) String() string {
 type Token struct {
 	Type    TokenType
 	Literal string
-	Column  int
-	Line    int
+	// Start is the position of the token's first character, and End the
+	// position just past its last.
+	Start Pos
+	End   Pos
+	// Parts is set on interpolated string tokens and holds the literal
+	// text and ${...} pieces in order.
+	Parts []StringPart
+	// Comments holds the comments that appear between the previous token
+	// and this one. The lexer itself ignores them.
+	Comments []Comment
+}
+
+// StringPart is a piece of an interpolated string: either literal Text or,
+// when Tokens is non-nil, the tokens of an embedded expression.
+type StringPart struct {
+	Text   string
+	Tokens []Token
+}
+
+// Comment is a `//` line comment or a `/* */` block comment, kept as trivia
+// for tools such as formatters. Text includes the delimiters.
+type Comment struct {
+	Text  string
+	Block bool
+	Pos   Pos
+}
+
+func (t Token) Pos() Pos {
+	return t.Start
+}
+
+func (t Token) Span() Span {
+	return Span{Start: t.Start, End: t.End}
 }
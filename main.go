@@ -3,57 +3,65 @@ package main
 import (
 	"bufio"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/printchard/tiny-lang/lexer"
 	"github.com/printchard/tiny-lang/parser"
+	"github.com/printchard/tiny-lang/tiny"
+	"github.com/printchard/tiny-lang/vm"
 )
 
+var useVM = flag.Bool("vm", false, "run programs on the bytecode VM instead of the tree-walking interpreter")
+
 func main() {
-	if len(os.Args) < 2 {
+	flag.Parse()
+	if flag.NArg() < 1 {
 		repl()
 		return
 	}
 
-	path := os.Args[1]
-	input, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Println("Error reading file:", err)
-		return
+	path := flag.Arg(0)
+	opts := []tiny.Option{
+		tiny.WithStdin(os.Stdin),
+		tiny.WithStdout(os.Stdout),
+		tiny.WithStderr(os.Stderr),
+		tiny.WithWarnings(func(d tiny.Diagnostic) {
+			fmt.Println(d.Format())
+		}),
 	}
-	lex := lexer.New(string(input))
-	tokens, err := lex.Tokenize()
-	if err != nil {
-		var lexerErr *lexer.LexerError
-		if errors.As(err, &lexerErr) {
-			fmt.Println(lexerErr.Format(path))
-		} else {
-			fmt.Printf("Generic Error: %v\n", err)
-		}
-		os.Exit(1)
+	if *useVM {
+		opts = append(opts, tiny.WithVM())
 	}
+	_, err := tiny.New(opts...).RunFile(path)
 
-	p := parser.New(tokens)
-	env := parser.NewDefaultEnvironment()
-	if err := p.Execute(env); err != nil {
-		var parserErr *parser.ParserError
-		var runtimeErr *parser.RuntimeError
-		if errors.As(err, &runtimeErr) {
-			fmt.Println(runtimeErr.Format(path, string(input)))
-		} else if errors.As(err, &parserErr) {
-			fmt.Println(parserErr.Format(path))
-		} else {
-			fmt.Printf("Generic Error: %v\n", err)
+	var syntaxErr *tiny.SyntaxError
+	var runtimeErr *tiny.RuntimeError
+	switch {
+	case err == nil:
+	case errors.As(err, &syntaxErr):
+		for _, diag := range syntaxErr.Diagnostics {
+			fmt.Println(diag.Format())
 		}
 		os.Exit(1)
+	case errors.As(err, &runtimeErr):
+		fmt.Println(runtimeErr.Format())
+		os.Exit(1)
+	default:
+		fmt.Println("Error reading file:", err)
 	}
 }
 
 func repl() {
 	env := parser.NewDefaultEnvironment()
+	fset := env.FileSet()
+	machine := vm.New(env)
 	reader := bufio.NewReader(os.Stdin)
+	// Scripts share the REPL's reader, so input sees the lines after the
+	// one that called it.
+	env.SetIO(parser.IO{Stdin: reader, Stdout: os.Stdout, Stderr: os.Stderr})
 
 	for {
 		fmt.Print("tiny-lang> ")
@@ -69,30 +77,61 @@ func repl() {
 			continue
 		}
 
-		lex := lexer.New(input)
+		// Each line is a file of its own, so that errors in functions
+		// defined on earlier lines point at those lines.
+		file := fset.AddFile("<stdin>", input)
+		lex := lexer.New(file)
 		tokens, err := lex.Tokenize()
 		if err != nil {
-			fmt.Println(err)
+			printError(fset, err)
 			continue
 		}
 
-		p := parser.New(tokens)
+		p := parser.New(file, tokens)
 		stmts, err := p.Parse()
 		if err != nil {
-			fmt.Println(err)
+			printError(fset, err)
+			continue
+		}
+		if err := parser.Resolve(stmts, env); err != nil {
+			printError(fset, err)
 			continue
 		}
 		for _, stmt := range stmts {
-			if expr, ok := stmt.(parser.ExpressionStatement); ok {
+			if *useVM {
+				val, err := machine.Run([]parser.Statement{stmt})
+				if err != nil {
+					printError(fset, err)
+				} else if _, ok := stmt.(parser.ExpressionStatement); ok {
+					fmt.Println(val)
+				}
+			} else if expr, ok := stmt.(parser.ExpressionStatement); ok {
 				val, err := expr.ExecuteValue(env)
 				if err != nil {
-					fmt.Println(err)
+					printError(fset, err)
 					continue
 				}
 				fmt.Println(val)
 			} else if err := stmt.Execute(env); err != nil {
-				fmt.Println(err)
+				printError(fset, err)
 			}
 		}
 	}
 }
+
+// printError prints an error found in the REPL's input, with the source it
+// refers to when fset can locate it.
+func printError(fset *lexer.FileSet, err error) {
+	var diags lexer.Diagnostics
+	var runtimeErr *parser.RuntimeError
+	switch {
+	case errors.As(err, &diags):
+		for _, diag := range diags {
+			fmt.Println(diag.Format(fset))
+		}
+	case errors.As(err, &runtimeErr):
+		fmt.Println(runtimeErr.Format(fset))
+	default:
+		fmt.Println(err)
+	}
+}
@@ -11,6 +11,12 @@ import (
 type Node interface {
 	String() string
 	GetToken() lexer.Token
+	// Span covers the whole construct, from its first to its last token.
+	Span() lexer.Span
+}
+
+func spanOf(start, end lexer.Span) lexer.Span {
+	return lexer.Span{Start: start.Start, End: end.End}
 }
 
 type Expression interface {
@@ -31,6 +37,46 @@ func (s *ReturnSignal) Error() string {
 	return "return signal"
 }
 
+// BreakSignal and ContinueSignal leave the loop named by Label, or the
+// innermost loop when it is empty. The parser only accepts them inside a
+// loop with that label.
+type BreakSignal struct {
+	Label string
+}
+
+func (s *BreakSignal) Error() string {
+	return "break signal"
+}
+
+type ContinueSignal struct {
+	Label string
+}
+
+func (s *ContinueSignal) Error() string {
+	return "continue signal"
+}
+
+// targets reports whether a break or continue for signalLabel leaves the
+// loop with the given label.
+func targets(signalLabel string, label *lexer.Token) bool {
+	return signalLabel == "" || label != nil && label.Literal == signalLabel
+}
+
+// endIteration handles the error that ended an iteration of the loop with
+// the given label, reporting whether the loop is done and what it returns.
+func endIteration(err error, label *lexer.Token) (bool, error) {
+	var brk *BreakSignal
+	var cont *ContinueSignal
+	switch {
+	case errors.As(err, &brk) && targets(brk.Label, label):
+		return true, nil
+	case errors.As(err, &cont) && targets(cont.Label, label):
+		return false, nil
+	default:
+		return true, err
+	}
+}
+
 type NumberLiteral struct {
 	Value float64
 	lexer.Token
@@ -40,6 +86,10 @@ func (n *NumberLiteral) GetToken() lexer.Token {
 	return n.Token
 }
 
+func (n *NumberLiteral) Span() lexer.Span {
+	return n.Token.Span()
+}
+
 func (n *NumberLiteral) String() string {
 	return fmt.Sprintf("%f", n.Value)
 }
@@ -57,6 +107,10 @@ func (s *StringLiteral) GetToken() lexer.Token {
 	return s.Token
 }
 
+func (s *StringLiteral) Span() lexer.Span {
+	return s.Token.Span()
+}
+
 func (s *StringLiteral) String() string {
 	return fmt.Sprintf("%q", s.Value)
 }
@@ -65,6 +119,47 @@ func (s *StringLiteral) Eval(env *Environment) (Value, error) {
 	return Value{Type: String, Str: s.Value}, nil
 }
 
+// InterpolatedString concatenates its parts, converting non-string values
+// with Value.String.
+type InterpolatedString struct {
+	Parts []Expression
+	lexer.Token
+}
+
+func (s *InterpolatedString) GetToken() lexer.Token {
+	return s.Token
+}
+
+func (s *InterpolatedString) Span() lexer.Span {
+	return s.Token.Span()
+}
+
+func (s *InterpolatedString) String() string {
+	var str strings.Builder
+	str.WriteByte('"')
+	for _, part := range s.Parts {
+		if lit, ok := part.(*StringLiteral); ok {
+			str.WriteString(lit.Value)
+		} else {
+			fmt.Fprintf(&str, "${%s}", part.String())
+		}
+	}
+	str.WriteByte('"')
+	return str.String()
+}
+
+func (s *InterpolatedString) Eval(env *Environment) (Value, error) {
+	var parts []Value
+	for _, part := range s.Parts {
+		value, err := part.Eval(env)
+		if err != nil {
+			return Value{}, err
+		}
+		parts = append(parts, value)
+	}
+	return Concat(parts), nil
+}
+
 type BooleanLiteral struct {
 	Value bool
 	lexer.Token
@@ -74,6 +169,10 @@ func (b *BooleanLiteral) GetToken() lexer.Token {
 	return b.Token
 }
 
+func (b *BooleanLiteral) Span() lexer.Span {
+	return b.Token.Span()
+}
+
 func (b *BooleanLiteral) String() string {
 	return fmt.Sprintf("%t", b.Value)
 }
@@ -85,18 +184,22 @@ func (b *BooleanLiteral) Eval(env *Environment) (Value, error) {
 type ArrayLiteral struct {
 	Elements []Expression
 	lexer.Token
+	RightBracket lexer.Token
 }
 
 func (a *ArrayLiteral) GetToken() lexer.Token {
 	return a.Token
 }
 
+func (a *ArrayLiteral) Span() lexer.Span {
+	return spanOf(a.Token.Span(), a.RightBracket.Span())
+}
+
 func (a *ArrayLiteral) String() string {
 	var elements []string
 	for _, elem := range a.Elements {
 		elements = append(elements, elem.String())
 	}
-	fmt.Printf("ArrayLiteral: %s\n", strings.Join(elements, ", "))
 	return fmt.Sprintf("[%s]", strings.Join(elements, ", "))
 }
 
@@ -109,9 +212,57 @@ func (a *ArrayLiteral) Eval(env *Environment) (Value, error) {
 		}
 		values = append(values, value)
 	}
+	if b := env.Budget(); b != nil {
+		if err := b.Allocate(len(values)); err != nil {
+			return Value{}, WrapRuntimeError(a, err)
+		}
+	}
 	return Value{Type: Array, Array: values}, nil
 }
 
+// MapLiteral builds a map from its entries, evaluating each key before its
+// value.
+type MapLiteral struct {
+	Keys   []Expression
+	Values []Expression
+	lexer.Token
+	RightBrace lexer.Token
+}
+
+func (m *MapLiteral) GetToken() lexer.Token {
+	return m.Token
+}
+
+func (m *MapLiteral) Span() lexer.Span {
+	return spanOf(m.Token.Span(), m.RightBrace.Span())
+}
+
+func (m *MapLiteral) String() string {
+	var entries []string
+	for i, key := range m.Keys {
+		entries = append(entries, fmt.Sprintf("%s: %s", key, m.Values[i]))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(entries, ", "))
+}
+
+func (m *MapLiteral) Eval(env *Environment) (Value, error) {
+	result := NewOrderedMap()
+	for i, keyExpr := range m.Keys {
+		key, err := keyExpr.Eval(env)
+		if err != nil {
+			return Value{}, err
+		}
+		value, err := m.Values[i].Eval(env)
+		if err != nil {
+			return Value{}, err
+		}
+		if err := result.Set(key, value); err != nil {
+			return Value{}, NewRuntimeError(keyExpr, err.Error())
+		}
+	}
+	return Value{Type: Map, Map: result}, nil
+}
+
 type VoidLiteral lexer.Token
 
 func (v VoidLiteral) Eval(env *Environment) (Value, error) {
@@ -122,24 +273,38 @@ func (v VoidLiteral) GetToken() lexer.Token {
 	return lexer.Token(v)
 }
 
+func (v VoidLiteral) Span() lexer.Span {
+	return lexer.Token(v).Span()
+}
+
 func (v VoidLiteral) String() string {
 	return "void"
 }
 
 type Identifier struct {
 	Token lexer.Token
+	// Local, Depth and Slot are set by Resolve. A local lives in slot Slot
+	// of the environment Depth levels above the one it is used in; any
+	// other identifier is a global, looked up by name.
+	Local bool
+	Depth int
+	Slot  int
 }
 
 func (i *Identifier) GetToken() lexer.Token {
 	return i.Token
 }
 
+func (i *Identifier) Span() lexer.Span {
+	return i.Token.Span()
+}
+
 func (i *Identifier) String() string {
 	return i.Token.Literal
 }
 
 func (i *Identifier) Eval(env *Environment) (Value, error) {
-	if value, ok := env.Get(i.String()); ok {
+	if value, ok := env.lookup(i); ok {
 		return value, nil
 	}
 	return Value{}, NewRuntimeError(i, fmt.Sprintf("undefined variable: %s", i.String()))
@@ -156,6 +321,10 @@ func (b *BinaryExpression) GetToken() lexer.Token {
 	return b.OpToken
 }
 
+func (b *BinaryExpression) Span() lexer.Span {
+	return spanOf(b.Left.Span(), b.Right.Span())
+}
+
 func (b *BinaryExpression) String() string {
 	return fmt.Sprintf("%s %s %s", b.Left.String(), b.Op, b.Right.String())
 }
@@ -169,65 +338,11 @@ func (b *BinaryExpression) Eval(env *Environment) (Value, error) {
 	if err != nil {
 		return Value{}, err
 	}
-	if left.Type != right.Type {
-		return Value{}, NewRuntimeError(b, fmt.Sprintf("type mismatch: %s and %s", left.Type, right.Type))
-	}
-
-	switch left.Type {
-	case Number:
-		switch b.Op {
-		case lexer.PlusToken:
-			return Value{Type: Number, Number: left.Number + right.Number}, nil
-		case lexer.MinusToken:
-			return Value{Type: Number, Number: left.Number - right.Number}, nil
-		case lexer.MultiplyToken:
-			return Value{Type: Number, Number: left.Number * right.Number}, nil
-		case lexer.DivideToken:
-			if right.Number == 0 {
-				return Value{}, NewRuntimeError(b, "division by zero")
-			}
-			return Value{Type: Number, Number: left.Number / right.Number}, nil
-		case lexer.EqualToken:
-			return Value{Type: Boolean, Boolean: left.Number == right.Number}, nil
-		case lexer.NotEqualToken:
-			return Value{Type: Boolean, Boolean: left.Number != right.Number}, nil
-		case lexer.LTToken:
-			return Value{Type: Boolean, Boolean: left.Number < right.Number}, nil
-		case lexer.LEQToken:
-			return Value{Type: Boolean, Boolean: left.Number <= right.Number}, nil
-		case lexer.GTToken:
-			return Value{Type: Boolean, Boolean: left.Number > right.Number}, nil
-		case lexer.GEQToken:
-			return Value{Type: Boolean, Boolean: left.Number >= right.Number}, nil
-		default:
-			return Value{}, NewRuntimeError(b, fmt.Sprintf("unknown operator: %s", b.Op))
-		}
-	case String:
-		switch b.Op {
-		case lexer.PlusToken:
-			return Value{Type: String, Str: left.Str + right.Str}, nil
-		case lexer.EqualToken:
-			return Value{Type: Boolean, Boolean: left.Str == right.Str}, nil
-		case lexer.NotEqualToken:
-			return Value{Type: Boolean, Boolean: left.Str != right.Str}, nil
-		default:
-			return Value{}, NewRuntimeError(b, fmt.Sprintf("unknown operator for strings: %s", b.Op))
-		}
-	default:
-		bLeft, bRight := left.AsBoolean(), right.AsBoolean()
-		switch b.Op {
-		case lexer.EqualToken:
-			return Value{Type: Boolean, Boolean: bLeft == bRight}, nil
-		case lexer.NotEqualToken:
-			return Value{Type: Boolean, Boolean: bLeft != bRight}, nil
-		case lexer.AndToken:
-			return Value{Type: Boolean, Boolean: bLeft && bRight}, nil
-		case lexer.OrToken:
-			return Value{Type: Boolean, Boolean: bLeft || bRight}, nil
-		default:
-			return Value{}, NewRuntimeError(b, fmt.Sprintf("unsupported types for binary operations: %s, %s", left.Type, right.Type))
-		}
+	result, err := BinaryOp(b.Op, left, right)
+	if err != nil {
+		return Value{}, NewRuntimeError(b, err.Error())
 	}
+	return result, nil
 }
 
 type UnaryExpression struct {
@@ -240,6 +355,10 @@ func (u *UnaryExpression) GetToken() lexer.Token {
 	return u.OpToken
 }
 
+func (u *UnaryExpression) Span() lexer.Span {
+	return spanOf(u.OpToken.Span(), u.Right.Span())
+}
+
 func (u *UnaryExpression) String() string {
 	return fmt.Sprintf("%s %s", u.Op, u.Right.String())
 }
@@ -249,34 +368,28 @@ func (u *UnaryExpression) Eval(env *Environment) (Value, error) {
 	if err != nil {
 		return Value{}, err
 	}
-	switch value.Type {
-	case Number:
-		switch u.Op {
-		case lexer.MinusToken:
-			return Value{Type: Number, Number: -value.Number}, nil
-		default:
-			return Value{}, NewRuntimeError(u, fmt.Sprintf("unknown unary operator: %s", u.Op))
-		}
-	default:
-		switch u.Op {
-		case lexer.NotToken:
-			return Value{Type: Boolean, Boolean: value.AsBoolean()}, nil
-		default:
-			return Value{}, NewRuntimeError(u, fmt.Sprintf("unknown unary operator for boolean: %s", u.Op))
-		}
+	result, err := UnaryOp(u.Op, value)
+	if err != nil {
+		return Value{}, NewRuntimeError(u, err.Error())
 	}
+	return result, nil
 }
 
 type PostfixExpression struct {
 	Left         Expression
 	Index        Expression
 	BracketToken lexer.Token
+	RightBracket lexer.Token
 }
 
 func (p *PostfixExpression) GetToken() lexer.Token {
 	return p.BracketToken
 }
 
+func (p *PostfixExpression) Span() lexer.Span {
+	return spanOf(p.Left.Span(), p.RightBracket.Span())
+}
+
 func (p *PostfixExpression) String() string {
 	return fmt.Sprintf("%s[%s]", p.Left.String(), p.Index.String())
 }
@@ -290,16 +403,43 @@ func (p *PostfixExpression) Eval(env *Environment) (Value, error) {
 	if err != nil {
 		return Value{}, err
 	}
-	if left.Type != Array {
-		return Value{}, NewRuntimeError(p, fmt.Sprintf("left side of postfix expression must be an array, got %s", left.Type))
+	result, err := Index(left, index)
+	if err != nil {
+		return Value{}, NewRuntimeError(p, err.Error())
 	}
-	if index.Type != Number {
-		return Value{}, NewRuntimeError(p, fmt.Sprintf("index must be a number, got %s", index.Type))
+	return result, nil
+}
+
+// FieldExpression reads a field of a record. Errors point at the field
+// name.
+type FieldExpression struct {
+	Left     Expression
+	Field    lexer.Token
+	DotToken lexer.Token
+}
+
+func (f *FieldExpression) GetToken() lexer.Token {
+	return f.Field
+}
+
+func (f *FieldExpression) Span() lexer.Span {
+	return spanOf(f.Left.Span(), f.Field.Span())
+}
+
+func (f *FieldExpression) String() string {
+	return fmt.Sprintf("%s.%s", f.Left.String(), f.Field.Literal)
+}
+
+func (f *FieldExpression) Eval(env *Environment) (Value, error) {
+	left, err := f.Left.Eval(env)
+	if err != nil {
+		return Value{}, err
 	}
-	if int(index.Number) < 0 || int(index.Number) >= len(left.Array) {
-		return Value{}, NewRuntimeError(p, fmt.Sprintf("index out of bounds: %d", int(index.Number)))
+	result, err := GetField(left, f.Field.Literal)
+	if err != nil {
+		return Value{}, NewRuntimeError(f, err.Error())
 	}
-	return left.Array[int(index.Number)], nil
+	return result, nil
 }
 
 type DeclarationStatement struct {
@@ -312,20 +452,28 @@ func (d *DeclarationStatement) GetToken() lexer.Token {
 	return d.LetToken
 }
 
+func (d *DeclarationStatement) Span() lexer.Span {
+	return spanOf(d.LetToken.Span(), d.Value.Span())
+}
+
 func (d *DeclarationStatement) String() string {
 	return fmt.Sprintf("let %s = %s", d.Identifier.String(), d.Value.String())
 }
 
 func (d *DeclarationStatement) Execute(env *Environment) error {
-	if _, ok := env.Get(d.Identifier.String()); ok {
-		return NewRuntimeError(d, fmt.Sprintf("variable already declared: %s", d.Identifier.String()))
+	// Resolve rejects duplicate locals, but globals can still be defined by
+	// the host between resolving and running a program.
+	if !d.Identifier.Local {
+		if env.Declared(d.Identifier.String()) {
+			return NewRuntimeError(d, fmt.Sprintf("variable already declared: %s", d.Identifier.String()))
+		}
 	}
 	value, err := d.Value.Eval(env)
 	if err != nil {
 		return err
 	}
 
-	env.Define(d.Identifier.String(), value)
+	env.declare(d.Identifier, value)
 	return nil
 }
 
@@ -339,24 +487,28 @@ func (a *AssignmentStatement) GetToken() lexer.Token {
 	return a.AssignToken
 }
 
+func (a *AssignmentStatement) Span() lexer.Span {
+	return spanOf(a.Identifier.Span(), a.Value.Span())
+}
+
 func (a *AssignmentStatement) String() string {
 	return fmt.Sprintf("%s = %s", a.Identifier.String(), a.Value.String())
 }
 
 func (a *AssignmentStatement) Execute(env *Environment) error {
-	if _, ok := env.Get(a.Identifier.String()); !ok {
+	if _, ok := env.lookup(a.Identifier); !ok {
 		return NewRuntimeError(a, fmt.Sprintf("undefined variable: %s", a.Identifier.String()))
 	}
 	value, err := a.Value.Eval(env)
 	if err != nil {
 		return err
 	}
-	env.Set(a.Identifier.String(), value)
+	env.assign(a.Identifier, value)
 	return nil
 }
 
 type IndexAssignmentStatement struct {
-	Left        *Identifier
+	Left        Expression
 	Index       Expression
 	Value       Expression
 	AssignToken lexer.Token
@@ -366,16 +518,21 @@ func (i *IndexAssignmentStatement) GetToken() lexer.Token {
 	return i.AssignToken
 }
 
+func (i *IndexAssignmentStatement) Span() lexer.Span {
+	return spanOf(i.Left.Span(), i.Value.Span())
+}
+
 func (i *IndexAssignmentStatement) String() string {
 	return fmt.Sprintf("%s[%s] = %s", i.Left.String(), i.Index.String(), i.Value.String())
 }
 
 func (i *IndexAssignmentStatement) Execute(env *Environment) error {
-	arr, ok := env.Get(i.Left.String())
-	if !ok {
-		return NewRuntimeError(i, fmt.Sprintf("undefined variable: %s", i.Left.String()))
-	} else if arr.Type != Array {
-		return NewRuntimeError(i, fmt.Sprintf("left side of index assignment must be an array, got %s", arr.Type))
+	arr, err := i.Left.Eval(env)
+	if err != nil {
+		return err
+	}
+	if err := CheckIndexTarget(arr); err != nil {
+		return NewRuntimeError(i, err.Error())
 	}
 	index, err := i.Index.Eval(env)
 	if err != nil {
@@ -385,13 +542,44 @@ func (i *IndexAssignmentStatement) Execute(env *Environment) error {
 	if err != nil {
 		return err
 	}
-	if index.Type != Number {
-		return NewRuntimeError(i, fmt.Sprintf("index must be a number, got %s", index.Type))
+	if err := SetIndex(arr, index, value); err != nil {
+		return NewRuntimeError(i, err.Error())
 	}
-	if int(index.Number) < 0 || int(index.Number) >= len(arr.Array) {
-		return NewRuntimeError(i, fmt.Sprintf("index out of bounds: %d", int(index.Number)))
+	return nil
+}
+
+type FieldAssignmentStatement struct {
+	Target      *FieldExpression
+	Value       Expression
+	AssignToken lexer.Token
+}
+
+func (f *FieldAssignmentStatement) GetToken() lexer.Token {
+	return f.AssignToken
+}
+
+func (f *FieldAssignmentStatement) Span() lexer.Span {
+	return spanOf(f.Target.Span(), f.Value.Span())
+}
+
+func (f *FieldAssignmentStatement) String() string {
+	return fmt.Sprintf("%s = %s", f.Target.String(), f.Value.String())
+}
+
+func (f *FieldAssignmentStatement) Execute(env *Environment) error {
+	record, err := f.Target.Left.Eval(env)
+	if err != nil {
+		return err
 	}
-	arr.Array[int(index.Number)] = value
+	name := f.Target.Field.Literal
+	if err := CheckFieldTarget(record, name); err != nil {
+		return NewRuntimeError(f.Target, err.Error())
+	}
+	value, err := f.Value.Eval(env)
+	if err != nil {
+		return err
+	}
+	SetField(record, name, value)
 	return nil
 }
 
@@ -400,12 +588,21 @@ type IfStatement struct {
 	Then      []Statement
 	Else      []Statement
 	IfToken   lexer.Token
+	// RightBrace closes the last block of the statement, including any
+	// else-if chain.
+	RightBrace lexer.Token
+	// slots is the frame size of the larger branch.
+	slots int
 }
 
 func (i *IfStatement) GetToken() lexer.Token {
 	return i.IfToken
 }
 
+func (i *IfStatement) Span() lexer.Span {
+	return spanOf(i.IfToken.Span(), i.RightBrace.Span())
+}
+
 func (i *IfStatement) String() string {
 	var thenBody strings.Builder
 	for _, stmt := range i.Then {
@@ -424,62 +621,158 @@ func (i *IfStatement) Execute(env *Environment) error {
 		return err
 	}
 
-	childEnv := NewEnvironment(env)
+	childEnv := newFrame(env, i.slots)
 
 	if val.AsBoolean() {
-		for _, stmt := range i.Then {
-			if err := stmt.Execute(childEnv); err != nil {
-				return err
-			}
-		}
-	} else {
-		for _, stmt := range i.Else {
-			if err := stmt.Execute(childEnv); err != nil {
-				return err
-			}
-		}
+		return executeBlock(i.Then, childEnv)
 	}
-	return nil
+	return executeBlock(i.Else, childEnv)
 }
 
 type WhileStatement struct {
-	Condition  Expression
-	Body       []Statement
+	Condition Expression
+	Body      []Statement
+	// Label is the loop's label, if it has one.
+	Label      *lexer.Token
 	WhileToken lexer.Token
+	RightBrace lexer.Token
+	slots      int
 }
 
 func (w *WhileStatement) GetToken() lexer.Token {
 	return w.WhileToken
 }
 
+func (w *WhileStatement) Span() lexer.Span {
+	if w.Label != nil {
+		return spanOf(w.Label.Span(), w.RightBrace.Span())
+	}
+	return spanOf(w.WhileToken.Span(), w.RightBrace.Span())
+}
+
 func (w *WhileStatement) String() string {
 	var body strings.Builder
 	for _, stmt := range w.Body {
 		body.WriteString(stmt.String() + "\n")
 	}
+	if w.Label != nil {
+		return fmt.Sprintf("%s: while %s {\n%s}", w.Label.Literal, w.Condition.String(), body.String())
+	}
 	return fmt.Sprintf("while %s {\n%s}", w.Condition.String(), body.String())
 }
 
 func (w *WhileStatement) Execute(env *Environment) error {
-	val, err := w.Condition.Eval(env)
-	if err != nil {
-		return err
-	}
+	for {
+		// Each test of the condition is a step, so that an empty loop still
+		// runs out of budget.
+		if err := env.step(w); err != nil {
+			return err
+		}
+		val, err := w.Condition.Eval(env)
+		if err != nil {
+			return err
+		}
+		if !val.AsBoolean() {
+			return nil
+		}
 
-	for val.AsBoolean() {
-		childEnv := NewEnvironment(env)
-		for _, stmt := range w.Body {
-			if err := stmt.Execute(childEnv); err != nil {
+		if err := executeBlock(w.Body, newFrame(env, w.slots)); err != nil {
+			if done, err := endIteration(err, w.Label); done {
 				return err
 			}
 		}
+	}
+}
 
-		val, err = w.Condition.Eval(env)
-		if err != nil {
+// ForStatement runs its body for each element of an array or character of
+// a string, or for each number from Iterable up to End when it is a range.
+type ForStatement struct {
+	// Index is bound to the position of each element, if it is given.
+	Index *Identifier
+	Value *Identifier
+	// Iterable is the value iterated over, or the start of a range.
+	Iterable Expression
+	// End is the end of a range, which it excludes, or nil.
+	End        Expression
+	Body       []Statement
+	Label      *lexer.Token
+	ForToken   lexer.Token
+	RightBrace lexer.Token
+	slots      int
+}
+
+func (f *ForStatement) GetToken() lexer.Token {
+	return f.ForToken
+}
+
+func (f *ForStatement) Span() lexer.Span {
+	if f.Label != nil {
+		return spanOf(f.Label.Span(), f.RightBrace.Span())
+	}
+	return spanOf(f.ForToken.Span(), f.RightBrace.Span())
+}
+
+func (f *ForStatement) String() string {
+	var str strings.Builder
+	if f.Label != nil {
+		str.WriteString(f.Label.Literal + ": ")
+	}
+	str.WriteString("for ")
+	if f.Index != nil {
+		str.WriteString(f.Index.String() + ", ")
+	}
+	fmt.Fprintf(&str, "%s in %s", f.Value, f.Iterable)
+	if f.End != nil {
+		fmt.Fprintf(&str, "..%s", f.End)
+	}
+	str.WriteString(" {\n")
+	for _, stmt := range f.Body {
+		str.WriteString(stmt.String() + "\n")
+	}
+	str.WriteString("}")
+	return str.String()
+}
+
+func (f *ForStatement) Execute(env *Environment) error {
+	iterable, err := f.Iterable.Eval(env)
+	if err != nil {
+		return err
+	}
+	var end Value
+	if f.End != nil {
+		if end, err = f.End.Eval(env); err != nil {
 			return err
 		}
 	}
-	return nil
+	seq, err := ForSequence(iterable, end, f.End != nil)
+	if err != nil {
+		return NewRuntimeError(f, err.Error())
+	}
+
+	for i := 0; ; i++ {
+		if err := env.step(f); err != nil {
+			return err
+		}
+		index, elem, ok := ForElement(seq, end, i)
+		if !ok {
+			return nil
+		}
+
+		// Each iteration binds the loop variables afresh, so closures
+		// created in the body keep the values of their own iteration.
+		childEnv := newFrame(env, f.slots)
+		if f.Index != nil {
+			childEnv.declare(f.Index, index)
+		} else if seq.Type == Map {
+			elem = index
+		}
+		childEnv.declare(f.Value, elem)
+		if err := executeBlock(f.Body, childEnv); err != nil {
+			if done, err := endIteration(err, f.Label); done {
+				return err
+			}
+		}
+	}
 }
 
 type Program struct {
@@ -495,8 +788,37 @@ func (p *Program) String() string {
 }
 
 func (p *Program) Execute(env *Environment) error {
-	for _, stmt := range p.Statements {
-		if err := stmt.Execute(env); err != nil {
+	return executeBlock(p.Statements, env)
+}
+
+// Run executes a resolved program in env and returns the value of its last
+// statement if that is an expression.
+func Run(stmts []Statement, env *Environment) (Value, error) {
+	for i, stmt := range stmts {
+		if expr, ok := stmt.(ExpressionStatement); ok && i == len(stmts)-1 {
+			if err := env.step(stmt); err != nil {
+				return Value{}, err
+			}
+			return expr.ExecuteValue(env)
+		}
+		if err := execute(stmt, env); err != nil {
+			return Value{}, err
+		}
+	}
+	return Value{}, nil
+}
+
+// execute runs stmt after counting it against the run's budget.
+func execute(stmt Statement, env *Environment) error {
+	if err := env.step(stmt); err != nil {
+		return err
+	}
+	return stmt.Execute(env)
+}
+
+func executeBlock(stmts []Statement, env *Environment) error {
+	for _, stmt := range stmts {
+		if err := execute(stmt, env); err != nil {
 			return err
 		}
 	}
@@ -511,6 +833,10 @@ func (e ExpressionStatement) GetToken() lexer.Token {
 	return e.Expr.GetToken()
 }
 
+func (e ExpressionStatement) Span() lexer.Span {
+	return e.Expr.Span()
+}
+
 func (e ExpressionStatement) Execute(env *Environment) error {
 	_, err := e.Expr.Eval(env)
 	return err
@@ -529,27 +855,37 @@ func (e ExpressionStatement) String() string {
 }
 
 type FunctionStatement struct {
-	Name      *Identifier
-	Args      []*Identifier
-	Body      []Statement
-	FuncToken lexer.Token
+	Name       *Identifier
+	Args       []*Identifier
+	Body       []Statement
+	FuncToken  lexer.Token
+	RightBrace lexer.Token
+	slots      int
 }
 
-func (f FunctionStatement) GetToken() lexer.Token {
+func (f *FunctionStatement) GetToken() lexer.Token {
 	return f.FuncToken
 }
 
-func (f FunctionStatement) Execute(env *Environment) error {
+func (f *FunctionStatement) Span() lexer.Span {
+	return spanOf(f.FuncToken.Span(), f.RightBrace.Span())
+}
+
+func (f *FunctionStatement) Execute(env *Environment) error {
+	env.declare(f.Name, Value{Type: Function, Function: f.function(f.Name.String(), env)})
+	return nil
+}
+
+// function creates the function f declares, defined in env.
+func (f *FunctionStatement) function(name string, env *Environment) Func {
 	var argNames []string
 	for _, arg := range f.Args {
 		argNames = append(argNames, arg.String())
 	}
-	funcVal := Func{ArgNames: argNames, Body: f.Body}
-	env.Set(f.Name.String(), Value{Type: Function, Function: funcVal})
-	return nil
+	return Func{Name: name, ArgNames: argNames, Body: f.Body, Env: env, slots: f.slots, decl: f}
 }
 
-func (f FunctionStatement) String() string {
+func (f *FunctionStatement) String() string {
 	var str strings.Builder
 	fmt.Fprintf(&str, "func %s(", f.Name)
 	str.WriteString(") {\n")
@@ -560,79 +896,446 @@ func (f FunctionStatement) String() string {
 	return str.String()
 }
 
+type StructStatement struct {
+	Name   *Identifier
+	Fields []lexer.Token
+	// Methods are declared like functions, with self added as their first
+	// argument.
+	Methods     []*FunctionStatement
+	StructToken lexer.Token
+	RightBrace  lexer.Token
+}
+
+func (s *StructStatement) GetToken() lexer.Token {
+	return s.StructToken
+}
+
+func (s *StructStatement) Span() lexer.Span {
+	return spanOf(s.StructToken.Span(), s.RightBrace.Span())
+}
+
+// NewType creates the type the statement declares, given the functions
+// created for its methods. Each time the statement runs it declares a new
+// one.
+func (s *StructStatement) NewType(methods []Func) *StructType {
+	fields := make([]string, len(s.Fields))
+	for i, field := range s.Fields {
+		fields[i] = field.Literal
+	}
+	t := NewStructType(s.Name.String(), fields)
+	for i, method := range s.Methods {
+		t.AddMethod(method.Name.String(), methods[i])
+	}
+	return t
+}
+
+// MethodName is the name a method is reported by in stack traces.
+func (s *StructStatement) MethodName(method *FunctionStatement) string {
+	return s.Name.String() + "." + method.Name.String()
+}
+
+func (s *StructStatement) Execute(env *Environment) error {
+	methods := make([]Func, len(s.Methods))
+	for i, method := range s.Methods {
+		methods[i] = method.function(s.MethodName(method), env)
+	}
+	env.declare(s.Name, Value{Type: Struct, Struct: s.NewType(methods)})
+	return nil
+}
+
+func (s *StructStatement) String() string {
+	fields := make([]string, len(s.Fields))
+	for i, field := range s.Fields {
+		fields[i] = field.Literal
+	}
+	var str strings.Builder
+	fmt.Fprintf(&str, "struct %s { %s", s.Name, strings.Join(fields, ", "))
+	for _, method := range s.Methods {
+		str.WriteString("\n  " + strings.ReplaceAll(method.String(), "\n", "\n  "))
+	}
+	str.WriteString(" }")
+	return str.String()
+}
+
+type FunctionLiteral struct {
+	Args       []*Identifier
+	Body       []Statement
+	FuncToken  lexer.Token
+	RightBrace lexer.Token
+	slots      int
+}
+
+func (f *FunctionLiteral) GetToken() lexer.Token {
+	return f.FuncToken
+}
+
+func (f *FunctionLiteral) Span() lexer.Span {
+	return spanOf(f.FuncToken.Span(), f.RightBrace.Span())
+}
+
+func (f *FunctionLiteral) Eval(env *Environment) (Value, error) {
+	var argNames []string
+	for _, arg := range f.Args {
+		argNames = append(argNames, arg.String())
+	}
+	funcVal := Func{Name: "<func>", ArgNames: argNames, Body: f.Body, Env: env, slots: f.slots, decl: f}
+	return Value{Type: Function, Function: funcVal}, nil
+}
+
+func (f *FunctionLiteral) String() string {
+	var str strings.Builder
+	str.WriteString("func")
+	for i, arg := range f.Args {
+		if i == 0 {
+			str.WriteString(": ")
+		} else {
+			str.WriteString(", ")
+		}
+		str.WriteString(arg.String())
+	}
+	str.WriteString(" {\n")
+	for _, stmt := range f.Body {
+		str.WriteString("  " + stmt.String() + "\n")
+	}
+	str.WriteString("}")
+	return str.String()
+}
+
 type FunctionCallExpression struct {
-	Name      *Identifier
-	Args      []Expression
-	LeftParen lexer.Token
+	Callee     Expression
+	Args       []Expression
+	LeftParen  lexer.Token
+	RightParen lexer.Token
 }
 
 func (f FunctionCallExpression) GetToken() lexer.Token {
 	return f.LeftParen
 }
 
+func (f FunctionCallExpression) Span() lexer.Span {
+	return spanOf(f.Callee.Span(), f.RightParen.Span())
+}
+
 func (f FunctionCallExpression) Eval(env *Environment) (Value, error) {
-	resolved, ok := env.Get(f.Name.String())
-	if !ok {
-		return Value{}, NewRuntimeError(f, fmt.Sprintf("undefined function: %s", f.Name))
+	if ident, ok := f.Callee.(*Identifier); ok {
+		if _, ok := env.lookup(ident); !ok {
+			return Value{}, NewRuntimeError(f, fmt.Sprintf("undefined function: %s", ident))
+		}
+	}
+	resolved, err := f.Callee.Eval(env)
+	if err != nil {
+		return Value{}, err
 	}
 
 	if resolved.Type == NativeFunction {
-		var args []Value
-		for _, arg := range f.Args {
-			v, err := arg.Eval(env)
-			if err != nil {
-				return Value{}, err
-			}
-			args = append(args, v)
+		args, err := f.evalArgs(env)
+		if err != nil {
+			return Value{}, err
 		}
 		nativeFn := resolved.NativeFunction
-		return nativeFn(args)
+		result, err := nativeFn(env, args)
+		if err != nil {
+			return Value{}, WrapRuntimeError(f, err)
+		}
+		return result, nil
+	}
+
+	if resolved.Type == Struct {
+		t := resolved.Struct
+		if err := t.CheckArity(len(f.Args)); err != nil {
+			return Value{}, NewRuntimeError(f, err.Error())
+		}
+		args, err := f.evalArgs(env)
+		if err != nil {
+			return Value{}, err
+		}
+		init, ok := t.Method("init")
+		if !ok {
+			return t.Construct(args), nil
+		}
+		record := t.New()
+		if _, err := f.call(env, init, append([]Value{record}, args...)); err != nil {
+			return Value{}, err
+		}
+		return record, nil
 	}
 
 	if resolved.Type != Function {
-		return Value{}, NewRuntimeError(f, fmt.Sprintf("function call to non-function type: %s", f.Name))
+		return Value{}, NewRuntimeError(f, fmt.Sprintf("function call to non-function type: %s", resolved.Type))
 	}
 
-	funcVal := resolved.Function
-	if len(f.Args) > len(funcVal.ArgNames) {
-		return Value{}, NewRuntimeError(f, fmt.Sprintf("too many arguments for function %s", f.Name))
-	} else if len(f.Args) < len(funcVal.ArgNames) {
-		return Value{}, NewRuntimeError(f, fmt.Sprintf("too few arguments for function %s", f.Name))
+	if arity := Arity(resolved); len(f.Args) > arity {
+		return Value{}, NewRuntimeError(f, fmt.Sprintf("too many arguments for function %s", f.Callee))
+	} else if len(f.Args) < arity {
+		return Value{}, NewRuntimeError(f, fmt.Sprintf("too few arguments for function %s", f.Callee))
 	}
+	args, err := f.evalArgs(env)
+	if err != nil {
+		return Value{}, err
+	}
+	return f.call(env, resolved.Function, CallArgs(resolved, args))
+}
 
-	funcEnv := NewEnvironment(env)
-	for i := 0; i < len(f.Args); i++ {
-		val, err := f.Args[i].Eval(env)
-		if err != nil {
-			return Value{}, err
+// call runs funcVal with args, which include self for a method.
+func (f FunctionCallExpression) call(env *Environment, funcVal Func, args []Value) (Value, error) {
+	funcEnv := newCallFrame(funcVal, env)
+	funcEnv.values = append(funcEnv.values, args...)
+	if b := env.Budget(); b != nil {
+		if err := b.Enter(); err != nil {
+			return Value{}, WrapRuntimeError(f, err)
 		}
-		funcEnv.Define(funcVal.ArgNames[i], val)
+		defer b.Leave()
 	}
-	for _, s := range funcVal.Body {
-		err := s.Execute(funcEnv)
-		var ret *ReturnSignal
-		if errors.As(err, &ret) {
-			return ret.Value, nil
-		} else if err != nil {
-			return Value{}, err
+	result, err := funcVal.run(funcEnv)
+	if err != nil {
+		return Value{}, AddStackFrame(err, funcVal.Name, f)
+	}
+	return result, nil
+}
+
+func (f FunctionCallExpression) evalArgs(env *Environment) ([]Value, error) {
+	var args []Value
+	for _, arg := range f.Args {
+		v, err := arg.Eval(env)
+		if err != nil {
+			return nil, err
 		}
+		args = append(args, v)
 	}
-	return Value{}, nil
+	return args, nil
 }
 
 func (f FunctionCallExpression) String() string {
 	var b strings.Builder
-	fmt.Fprintf(&b, "%s(", f.Name)
-	if len(f.Args) > 0 {
-		fmt.Fprint(&b, f.Args[0].String())
-	}
-	for _, arg := range f.Args[1:] {
-		fmt.Fprintf(&b, "%s, ", arg.String())
+	fmt.Fprintf(&b, "%s(", f.Callee)
+	for i, arg := range f.Args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(arg.String())
 	}
 	b.WriteByte(')')
 	return b.String()
 }
 
+type ThrowStatement struct {
+	Value      Expression
+	ThrowToken lexer.Token
+}
+
+func (t *ThrowStatement) GetToken() lexer.Token {
+	return t.ThrowToken
+}
+
+func (t *ThrowStatement) Span() lexer.Span {
+	return spanOf(t.ThrowToken.Span(), t.Value.Span())
+}
+
+func (t *ThrowStatement) Execute(env *Environment) error {
+	value, err := t.Value.Eval(env)
+	if err != nil {
+		return err
+	}
+	return Throw(t, value)
+}
+
+func (t *ThrowStatement) String() string {
+	return fmt.Sprintf("throw %s", t.Value)
+}
+
+// ImportStatement binds a module, or some of the names it exports, in the
+// importing file. Imports are only allowed at the top level of a file.
+type ImportStatement struct {
+	Path *StringLiteral
+	// Name is the variable an import of the whole module binds it to, and
+	// is nil for a selective import.
+	Name *Identifier
+	// Names are the exports a selective import binds.
+	Names       []ImportedName
+	ImportToken lexer.Token
+	// Module is the module imported, set by Resolve.
+	Module *ModuleFile
+}
+
+// ImportedName is an export bound by a selective import. Alias is the
+// variable it is bound to, which is Export itself unless it is renamed
+// with as.
+type ImportedName struct {
+	Export *Identifier
+	Alias  *Identifier
+}
+
+func (s *ImportStatement) GetToken() lexer.Token {
+	return s.ImportToken
+}
+
+func (s *ImportStatement) Span() lexer.Span {
+	if s.Name != nil {
+		return spanOf(s.ImportToken.Span(), s.Name.Span())
+	}
+	return spanOf(s.ImportToken.Span(), s.Path.Span())
+}
+
+// Bindings returns the variables the import declares.
+func (s *ImportStatement) Bindings() []*Identifier {
+	if s.Name != nil {
+		return []*Identifier{s.Name}
+	}
+	var ids []*Identifier
+	for _, name := range s.Names {
+		ids = append(ids, name.Alias)
+	}
+	return ids
+}
+
+func (s *ImportStatement) Execute(env *Environment) error {
+	for _, id := range s.Bindings() {
+		if env.Declared(id.String()) {
+			return NewRuntimeError(id, fmt.Sprintf("variable already declared: %s", id))
+		}
+	}
+	m := s.Module
+	err := m.Evaluate(s, func() error {
+		_, err := Run(m.Stmts, m.Env)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if s.Name != nil {
+		env.declare(s.Name, Value{Type: Module, Module: m})
+		return nil
+	}
+	for _, name := range s.Names {
+		value, _ := m.Export(name.Export.String())
+		env.declare(name.Alias, value)
+	}
+	return nil
+}
+
+func (s *ImportStatement) String() string {
+	if s.Name != nil {
+		return fmt.Sprintf("import %s as %s", s.Path, s.Name)
+	}
+	var names []string
+	for _, name := range s.Names {
+		if name.Alias == name.Export {
+			names = append(names, name.Export.String())
+		} else {
+			names = append(names, fmt.Sprintf("%s as %s", name.Export, name.Alias))
+		}
+	}
+	return fmt.Sprintf("import { %s } from %s", strings.Join(names, ", "), s.Path)
+}
+
+// ExportStatement makes the variable, function or struct Decl declares
+// visible to the files importing the module it is in.
+type ExportStatement struct {
+	Decl        Statement
+	ExportToken lexer.Token
+}
+
+func (e *ExportStatement) GetToken() lexer.Token {
+	return e.ExportToken
+}
+
+func (e *ExportStatement) Span() lexer.Span {
+	return spanOf(e.ExportToken.Span(), e.Decl.Span())
+}
+
+// Name returns the identifier the exported declaration declares.
+func (e *ExportStatement) Name() *Identifier {
+	switch decl := e.Decl.(type) {
+	case *DeclarationStatement:
+		return decl.Identifier
+	case *FunctionStatement:
+		return decl.Name
+	default:
+		return decl.(*StructStatement).Name
+	}
+}
+
+func (e *ExportStatement) Execute(env *Environment) error {
+	return e.Decl.Execute(env)
+}
+
+func (e *ExportStatement) String() string {
+	return "export " + e.Decl.String()
+}
+
+// TryStatement runs its body, handing the runtime errors raised in it to
+// the catch clause and running the finally clause however the body and
+// catch clause end, unless the program is stopped by its limits. Catch is
+// nil when there is no catch clause, and Finally when there is no finally
+// clause.
+type TryStatement struct {
+	Body []Statement
+	// CatchVar receives the caught value, and may be omitted.
+	CatchVar     *Identifier
+	Catch        []Statement
+	Finally      []Statement
+	TryToken     lexer.Token
+	RightBrace   lexer.Token
+	bodySlots    int
+	catchSlots   int
+	finallySlots int
+}
+
+func (t *TryStatement) GetToken() lexer.Token {
+	return t.TryToken
+}
+
+func (t *TryStatement) Span() lexer.Span {
+	return spanOf(t.TryToken.Span(), t.RightBrace.Span())
+}
+
+func (t *TryStatement) Execute(env *Environment) error {
+	err := executeBlock(t.Body, newFrame(env, t.bodySlots))
+	if t.Catch != nil {
+		if value, ok := Caught(env, err); ok {
+			frame := newFrame(env, t.catchSlots)
+			if t.CatchVar != nil {
+				frame.declare(t.CatchVar, value)
+			}
+			err = executeBlock(t.Catch, frame)
+		}
+	}
+	if t.Finally != nil && (err == nil || Catchable(err) || isSignal(err)) {
+		if err := executeBlock(t.Finally, newFrame(env, t.finallySlots)); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (t *TryStatement) String() string {
+	var str strings.Builder
+	str.WriteString("try {\n")
+	for _, stmt := range t.Body {
+		str.WriteString("  " + stmt.String() + "\n")
+	}
+	str.WriteString("}")
+	if t.Catch != nil {
+		str.WriteString(" catch ")
+		if t.CatchVar != nil {
+			str.WriteString(t.CatchVar.String() + " ")
+		}
+		str.WriteString("{\n")
+		for _, stmt := range t.Catch {
+			str.WriteString("  " + stmt.String() + "\n")
+		}
+		str.WriteString("}")
+	}
+	if t.Finally != nil {
+		str.WriteString(" finally {\n")
+		for _, stmt := range t.Finally {
+			str.WriteString("  " + stmt.String() + "\n")
+		}
+		str.WriteString("}")
+	}
+	return str.String()
+}
+
 type ReturnStatement struct {
 	Return      Expression
 	ReturnToken lexer.Token
@@ -642,6 +1345,13 @@ func (r *ReturnStatement) GetToken() lexer.Token {
 	return r.ReturnToken
 }
 
+func (r *ReturnStatement) Span() lexer.Span {
+	if r.Return == nil {
+		return r.ReturnToken.Span()
+	}
+	return spanOf(r.ReturnToken.Span(), r.Return.Span())
+}
+
 func (r ReturnStatement) Execute(env *Environment) error {
 	if r.Return == nil {
 		return &ReturnSignal{}
@@ -657,38 +1367,158 @@ func (r ReturnStatement) String() string {
 	return fmt.Sprintf("return %s", r.Return)
 }
 
+type BreakStatement struct {
+	BreakToken lexer.Token
+	// Label names the loop to leave, or is nil for the innermost one.
+	Label *lexer.Token
+}
+
+func (b *BreakStatement) GetToken() lexer.Token {
+	return b.BreakToken
+}
+
+func (b *BreakStatement) Span() lexer.Span {
+	if b.Label == nil {
+		return b.BreakToken.Span()
+	}
+	return spanOf(b.BreakToken.Span(), b.Label.Span())
+}
+
+func (b *BreakStatement) Execute(env *Environment) error {
+	if b.Label == nil {
+		return &BreakSignal{}
+	}
+	return &BreakSignal{Label: b.Label.Literal}
+}
+
+func (b *BreakStatement) String() string {
+	if b.Label == nil {
+		return "break"
+	}
+	return "break " + b.Label.Literal
+}
+
+type ContinueStatement struct {
+	ContinueToken lexer.Token
+	// Label names the loop to continue, or is nil for the innermost one.
+	Label *lexer.Token
+}
+
+func (c *ContinueStatement) GetToken() lexer.Token {
+	return c.ContinueToken
+}
+
+func (c *ContinueStatement) Span() lexer.Span {
+	if c.Label == nil {
+		return c.ContinueToken.Span()
+	}
+	return spanOf(c.ContinueToken.Span(), c.Label.Span())
+}
+
+func (c *ContinueStatement) Execute(env *Environment) error {
+	if c.Label == nil {
+		return &ContinueSignal{}
+	}
+	return &ContinueSignal{Label: c.Label.Literal}
+}
+
+func (c *ContinueStatement) String() string {
+	if c.Label == nil {
+		return "continue"
+	}
+	return "continue " + c.Label.Literal
+}
+
 type RuntimeError struct {
 	Msg string
 	lexer.Token
+	// Span is the range of the node that raised the error.
+	Span lexer.Span
+	// Err is the error returned by a native function, if that is what
+	// raised this one.
+	Err error
+	// Stack lists the calls the error unwound through, innermost first.
+	Stack []StackFrame
+	// Thrown is the value of the throw statement that raised the error, if
+	// it was one.
+	Thrown *Value
+}
+
+// StackFrame is a call to a script function that was in progress when a
+// runtime error was raised.
+type StackFrame struct {
+	// Function is the name of the function called, or "<func>" for a
+	// function literal.
+	Function string
+	// Token and Span locate the call in its caller.
+	lexer.Token
+	Span lexer.Span
 }
 
+// Error returns the error's message. Its position belongs to the FileSet
+// of the program that raised it, which Format looks it up in.
 func (e *RuntimeError) Error() string {
-	return fmt.Sprintf("[Line %d:%d]: %s", e.Token.Line, e.Token.Column, e.Msg)
+	return e.Msg
 }
 
-func (e *RuntimeError) Format(fileName, source string) string {
-	lines := strings.Split(source, "\n")
-	if e.Line > len(lines) || e.Line < 1 {
-		return fmt.Sprintf("[%s:%d:%d]: %s", fileName, e.Token.Line, e.Token.Column, e.Msg)
+// Format returns the error with an excerpt of the source that raised it,
+// followed by a traceback of the calls it unwound through. Runs of the same
+// call, as made by a recursive function, are folded into one. Each position
+// is shown with the file fset maps it to.
+func (e *RuntimeError) Format(fset *lexer.FileSet) string {
+	var b strings.Builder
+	pos := fset.Position(e.Start)
+	fmt.Fprintf(&b, "[%s:%d:%d]: %s", pos.Filename, pos.Line, pos.Column, e.Msg)
+	if excerpt := fset.File(e.Start).Underline(e.Span, e.Start); excerpt != "" {
+		b.WriteString("\n" + excerpt)
 	}
+	for i := 0; i < len(e.Stack); {
+		frame := e.Stack[i]
+		pos := fset.Position(frame.Start)
+		fmt.Fprintf(&b, "\n  in %s, called from [%s:%d:%d]", frame.Function, pos.Filename, pos.Line, pos.Column)
+		if excerpt := fset.File(frame.Start).Underline(frame.Span, frame.Start); excerpt != "" {
+			b.WriteString("\n" + excerpt)
+		}
+		repeated := 1
+		for i+repeated < len(e.Stack) && sameCall(e.Stack[i+repeated], frame) {
+			repeated++
+		}
+		if repeated > 1 {
+			fmt.Fprintf(&b, "\n  ... %d more calls to %s", repeated-1, frame.Function)
+		}
+		i += repeated
+	}
+	return b.String()
+}
 
-	errorLine := lines[e.Line-1]
+func sameCall(a, b StackFrame) bool {
+	return a.Function == b.Function && a.Span == b.Span
+}
 
-	var caretPadding strings.Builder
-	for i := 2; i < e.Token.Column; i++ {
-		if i < len(errorLine) && errorLine[i-1] == '\t' {
-			caretPadding.WriteString("\t")
-		} else {
-			caretPadding.WriteString(" ")
-		}
+// AddStackFrame records that err unwound through a call to function made
+// by the node call.
+func AddStackFrame(err error, function string, call Node) error {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		runtimeErr.Stack = append(runtimeErr.Stack, StackFrame{Function: function, Token: call.GetToken(), Span: call.Span()})
 	}
+	return err
+}
 
-	return fmt.Sprintf(
-		"[%s:%d:%d]: %s\n    %s\n    %s^",
-		fileName, e.Line, e.Column, e.Msg, errorLine, caretPadding.String(),
-	)
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
 }
 
 func NewRuntimeError(n Node, msg string) error {
-	return &RuntimeError{Msg: msg, Token: n.GetToken()}
+	return &RuntimeError{Msg: msg, Token: n.GetToken(), Span: n.Span()}
+}
+
+// WrapRuntimeError attributes an error returned by a native function to the
+// call n. Errors that already carry a position are returned unchanged.
+func WrapRuntimeError(n Node, err error) error {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return err
+	}
+	return &RuntimeError{Msg: err.Error(), Token: n.GetToken(), Span: n.Span(), Err: err}
 }
@@ -0,0 +1,39 @@
+package parser
+
+import "testing"
+
+func TestBreakContinue(t *testing.T) {
+	expectOutput(t, `let i := 0
+while true { i = i + 1
+  if i == 2 { continue }
+  if i > 3 { break }
+  print(i) }`, "1.000000\n3.000000\n")
+	expectOutput(t, `let i := 0
+outer: while i < 3 { i = i + 1
+  let j := 0
+  while true { j = j + 1
+    if j == 2 { continue outer }
+    if i == 3 { break outer }
+    print(i, j) } }
+print("done", i)`, "1.000000 1.000000\n2.000000 1.000000\ndone 3.000000\n")
+	expectOutput(t, `func first: n { while true { return n } }
+print(first(4))`, "4.000000\n")
+	expectError(t, `break`, "break outside loop")
+	expectError(t, `while true { func f { continue } }`, "continue outside loop")
+	expectError(t, `a: while true { break b }`, "undefined label: b")
+}
+
+func TestForIn(t *testing.T) {
+	expectOutput(t, `for i, x in ["a", "b"] { print(i, x) }`, "0.000000 a\n1.000000 b\n")
+	expectOutput(t, `for c in "hé!" { print(c) }`, "h\né\n!\n")
+	expectOutput(t, `let n := 0
+for i in 2..5 { n = n + i }
+for i in 3..3 { n = 100 }
+print(n)`, "9.000000\n")
+	expectOutput(t, `for k, v in {"b": 1, "a": 2} { print(k, v) }`, "b 1.000000\na 2.000000\n")
+	// Each iteration has its own loop variable.
+	expectOutput(t, `let fs := {}
+for i in 0..3 { fs[i] = func { return i } }
+print(fs[0](), fs[2]())`, "0.000000 2.000000\n")
+	expectError(t, `for x in 5 { }`, "cannot iterate over Number")
+}
@@ -0,0 +1,132 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// IO holds the streams the I/O builtins of a global scope use.
+type IO struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+type streams struct {
+	IO
+	// stdin buffers Stdin, so input does not lose what it reads past the
+	// end of a line.
+	stdin *bufio.Reader
+}
+
+// SetIO sets the streams used by builtins running in env's global scope.
+// Streams left nil are inherited from the enclosing scope, and default to
+// the process's standard streams.
+func (env *Environment) SetIO(streams IO) {
+	if env.globals.frozen {
+		panic("parser: cannot set the streams of a frozen environment")
+	}
+	env.globals.streams = newStreams(env.IO(), streams)
+}
+
+func newStreams(inherited, set IO) *streams {
+	if set.Stdin == nil {
+		set.Stdin = inherited.Stdin
+	}
+	if set.Stdout == nil {
+		set.Stdout = inherited.Stdout
+	}
+	if set.Stderr == nil {
+		set.Stderr = inherited.Stderr
+	}
+	s := &streams{IO: set}
+	if r, ok := set.Stdin.(*bufio.Reader); ok {
+		s.stdin = r
+	} else {
+		s.stdin = bufio.NewReader(set.Stdin)
+	}
+	return s
+}
+
+// IO returns the streams used by builtins running in env.
+func (env *Environment) IO() IO {
+	return env.ioStreams().IO
+}
+
+func (env *Environment) ioStreams() *streams {
+	for e := env.program(); e != nil; e = e.parent {
+		if e.streams != nil {
+			return e.streams
+		}
+	}
+	return stdio
+}
+
+var stdio = newStreams(IO{}, IO{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr})
+
+var builtins = &Environment{frozen: true, variables: map[string]Value{
+	"print": {
+		Type: NativeFunction,
+		NativeFunction: func(env *Environment, vs []Value) (Value, error) {
+			if len(vs) < 1 {
+				return Value{}, fmt.Errorf("print expects at least 1 value")
+			}
+			return Value{}, printValues(env.IO().Stdout, vs)
+		},
+	},
+	"eprint": {
+		Type: NativeFunction,
+		NativeFunction: func(env *Environment, vs []Value) (Value, error) {
+			if len(vs) < 1 {
+				return Value{}, fmt.Errorf("eprint expects at least 1 value")
+			}
+			return Value{}, printValues(env.IO().Stderr, vs)
+		},
+	},
+	"input": {
+		Type: NativeFunction,
+		NativeFunction: func(env *Environment, vs []Value) (Value, error) {
+			if len(vs) > 1 {
+				return Value{}, fmt.Errorf("input expects at most 1 value")
+			}
+			s := env.ioStreams()
+			if len(vs) == 1 {
+				if _, err := fmt.Fprint(s.Stdout, vs[0]); err != nil {
+					return Value{}, err
+				}
+			}
+			line, err := s.stdin.ReadString('\n')
+			if err == io.EOF && line == "" {
+				return Value{}, nil
+			} else if err != nil && err != io.EOF {
+				return Value{}, err
+			}
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			return Value{Type: String, Str: line}, nil
+		},
+	},
+	"keys":   {Type: NativeFunction, NativeFunction: mapKeys},
+	"values": {Type: NativeFunction, NativeFunction: mapValues},
+	"has":    {Type: NativeFunction, NativeFunction: mapHas},
+	"delete": {Type: NativeFunction, NativeFunction: mapDelete},
+}}
+
+func init() {
+	builtins.globals = builtins
+}
+
+func printValues(w io.Writer, vs []Value) error {
+	if _, err := fmt.Fprint(w, vs[0]); err != nil {
+		return err
+	}
+	for _, v := range vs[1:] {
+		if _, err := fmt.Fprintf(w, " %v", v); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -1,67 +1,275 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+
+	"github.com/printchard/tiny-lang/lexer"
 )
 
+// Environment holds the variables visible to running code. Globals are
+// kept by name so the host and the REPL can reach them; the locals of a
+// block or function call live in slots assigned by Resolve.
 type Environment struct {
 	variables map[string]Value
-	parent    *Environment
+	// version counts the changes to variables, so that caches of them can
+	// tell when they are stale.
+	version int
+	values  []Value
+	parent  *Environment
+	// globals is the nearest enclosing environment keyed by name.
+	globals *Environment
+	// frozen scopes are shared between environments and never change.
+	// Assigning to one of their variables defines it in the global scope
+	// the assignment runs in instead.
+	frozen bool
+	// containers names the variables visible from a frozen scope whose
+	// values forks copy, as reported by mutable.
+	containers []string
+	// streams are the I/O streams set for this global scope, if any.
+	streams *streams
+	// budget limits the program currently running in this global scope.
+	budget *Budget
+	// module is set on the global scope of an imported module.
+	module *ModuleFile
+	// modules holds the modules loaded by the program whose global scope
+	// this is, by absolute path.
+	modules map[string]*ModuleFile
+	// files locates the positions of the code run in this global scope,
+	// if it has its own FileSet.
+	files *lexer.FileSet
 }
 
+// NewEnvironment creates a scope for global variables on top of parent.
 func NewEnvironment(parent *Environment) *Environment {
-	return &Environment{
+	env := &Environment{
 		variables: make(map[string]Value),
 		parent:    parent,
 	}
+	env.globals = env
+	return env
 }
 
-var defaultVars map[string]Value = map[string]Value{
-	"print": {
-		Type: NativeFunction,
-		NativeFunction: func(vs []Value) (Value, error) {
-			if len(vs) < 1 {
-				return Value{}, fmt.Errorf("print expects at least 1 value")
-			}
+// newFrame creates the environment of a block with room for size locals.
+func newFrame(parent *Environment, size int) *Environment {
+	return &Environment{
+		values:  make([]Value, 0, size),
+		parent:  parent,
+		globals: parent.globals,
+	}
+}
 
-			fmt.Print(vs[0])
-			for _, v := range vs[1:] {
-				fmt.Printf(" %v", v)
-			}
-			fmt.Println()
-			return Value{}, nil
-		},
-	},
+// newCallFrame creates the environment of a call to f from caller. The
+// function sees the locals of the scope it was defined in, but the globals
+// of its caller's program, so functions copied into a forked environment
+// use the fork's globals, as they do on the VM. Functions of an imported
+// module always see the module's globals.
+func newCallFrame(f Func, caller *Environment) *Environment {
+	globals := caller.program()
+	if m := f.module(); m != nil {
+		globals = m.Env
+	}
+	return &Environment{
+		values:  make([]Value, 0, f.slots),
+		parent:  f.Env,
+		globals: globals,
+	}
 }
 
+// program returns the global scope of the program env belongs to: its own,
+// or for the code of an imported module, that of the program that loaded
+// it.
+func (env *Environment) program() *Environment {
+	if m := env.globals.module; m != nil {
+		return m.program
+	}
+	return env.globals
+}
+
+// NewDefaultEnvironment creates an empty global scope on top of the
+// builtins.
 func NewDefaultEnvironment() *Environment {
-	return &Environment{
-		variables: defaultVars,
+	return NewEnvironment(builtins)
+}
+
+// FileSet returns the set of files lexed for the program env belongs to,
+// which maps the positions in its errors back to their source. Forks share
+// the set of the environment they were forked from.
+func (env *Environment) FileSet() *lexer.FileSet {
+	for e := env.program(); e != nil; e = e.parent {
+		if e.files != nil {
+			return e.files
+		}
 	}
+	p := env.program()
+	p.files = lexer.NewFileSet()
+	return p.files
 }
 
+// Set, Define and Get address global variables by name. Locals are only
+// reachable through the slots Resolve binds identifiers to.
+
 func (env *Environment) Set(name string, value Value) {
-	if _, ok := env.variables[name]; ok {
-		env.variables[name] = value
-	} else {
-		if env.parent != nil {
-			env.parent.Set(name, value)
-		} else {
-			env.variables[name] = value
+	for e := env.globals; e != nil; e = e.parent {
+		if _, ok := e.variables[name]; ok {
+			// A module cannot assign to the globals of its program.
+			if !e.frozen && (e == env.globals || env.globals.module == nil) {
+				e.variables[name] = value
+				e.version++
+				return
+			}
+			break
 		}
 	}
+	env.Define(name, value)
 }
 
 func (env *Environment) Define(name string, value Value) {
-	env.variables[name] = value
+	if env.globals.frozen {
+		panic("parser: cannot define " + name + " in a frozen environment")
+	}
+	env.globals.variables[name] = value
+	env.globals.version++
 }
 
 func (env *Environment) Get(name string) (Value, bool) {
-	value, ok := env.variables[name]
-	if !ok && env.parent != nil {
-		return env.parent.Get(name)
+	for env = env.globals; env != nil; env = env.parent {
+		if value, ok := env.variables[name]; ok {
+			return value, true
+		}
+	}
+	return Value{}, false
+}
+
+// Declared reports whether name is a global of the program env belongs to,
+// or of its module. Builtins are not, so declarations can shadow them, and
+// neither are the program's globals to the code of a module.
+func (env *Environment) Declared(name string) bool {
+	for e := env.globals; e != nil && e != builtins; e = e.parent {
+		if _, ok := e.variables[name]; ok {
+			return true
+		}
+		if e.module != nil {
+			break
+		}
 	}
-	return value, ok
+	return false
+}
+
+// Version returns a number that changes whenever a variable of env's global
+// scope is set or defined.
+func (env *Environment) Version() int {
+	return env.globals.version
+}
+
+// Snapshot returns a frozen copy of env's globals. Later changes to env are
+// not seen by the snapshot, which is meant to be forked.
+func (env *Environment) Snapshot() *Environment {
+	var layers []*Environment
+	base := env.globals
+	for base != nil && !base.frozen {
+		layers = append(layers, base)
+		if base.parent == nil {
+			base = nil
+		} else {
+			base = base.parent.globals
+		}
+	}
+	if len(layers) == 0 {
+		return base
+	}
+
+	snapshot := &Environment{variables: make(map[string]Value), parent: base, frozen: true}
+	snapshot.globals = snapshot
+	if s := env.ioStreams(); s != stdio {
+		snapshot.streams = s
+	}
+	snapshot.files = env.FileSet()
+	c := newCopier(snapshot)
+	// Copy outer scopes first, so inner ones shadow them.
+	for i := len(layers) - 1; i >= 0; i-- {
+		for name, value := range layers[i].variables {
+			snapshot.variables[name] = c.Value(value)
+		}
+	}
+	snapshot.modules = c.modules(env.globals.modules)
+	for name, value := range snapshot.variables {
+		if mutable(value) {
+			snapshot.containers = append(snapshot.containers, name)
+		}
+	}
+	if base != nil {
+		for _, name := range base.containers {
+			if _, shadowed := snapshot.variables[name]; !shadowed {
+				snapshot.containers = append(snapshot.containers, name)
+			}
+		}
+	}
+	return snapshot
+}
+
+// Fork returns a new global scope that starts with env's globals and the
+// modules its program imported. Changes made through either environment
+// are not seen by the other, including those to the locals captured by
+// closures and to the globals of modules.
+//
+// Forking a snapshot is cheap: the fork is layered over it and only copies
+// the values that could otherwise be modified in place: arrays, maps,
+// records, modules and functions with captured state. A configured
+// environment can be snapshotted once and forked for each run.
+func (env *Environment) Fork() *Environment {
+	snapshot := env.Snapshot()
+	fork := NewEnvironment(snapshot)
+	c := newCopier(fork)
+	for _, name := range snapshot.containers {
+		value, _ := snapshot.Get(name)
+		fork.variables[name] = c.Value(value)
+	}
+	fork.modules = c.modules(snapshot.modules)
+	return fork
+}
+
+// frame returns the environment depth levels above env.
+func (env *Environment) frame(depth int) *Environment {
+	for ; depth > 0; depth-- {
+		env = env.parent
+	}
+	return env
+}
+
+// lookup reads the variable id is bound to. A local whose declaration has
+// not run yet is reported as missing.
+func (env *Environment) lookup(id *Identifier) (Value, bool) {
+	if !id.Local {
+		return env.Get(id.String())
+	}
+	frame := env.frame(id.Depth)
+	if id.Slot >= len(frame.values) {
+		return Value{}, false
+	}
+	return frame.values[id.Slot], true
+}
+
+// assign writes to the variable id is bound to, which must exist.
+func (env *Environment) assign(id *Identifier, value Value) {
+	if !id.Local {
+		env.Set(id.String(), value)
+		return
+	}
+	env.frame(id.Depth).values[id.Slot] = value
+}
+
+// declare defines the variable id names in env. Slots are assigned in the
+// order declarations run, so a new local is always the next one.
+func (env *Environment) declare(id *Identifier, value Value) {
+	if !id.Local {
+		env.Define(id.String(), value)
+		return
+	}
+	for len(env.values) <= id.Slot {
+		env.values = append(env.values, Value{})
+	}
+	env.values[id.Slot] = value
 }
 
 type ValueType int
@@ -74,6 +282,10 @@ const (
 	Array
 	Function
 	NativeFunction
+	Map
+	Struct
+	Record
+	Module
 )
 
 func (v ValueType) String() string {
@@ -92,6 +304,14 @@ func (v ValueType) String() string {
 		return "Function"
 	case NativeFunction:
 		return "NativeFn"
+	case Map:
+		return "Map"
+	case Struct:
+		return "Struct"
+	case Record:
+		return "Record"
+	case Module:
+		return "Module"
 
 	default:
 		return "unknown"
@@ -99,13 +319,18 @@ func (v ValueType) String() string {
 }
 
 type Value struct {
-	Type           ValueType
-	Number         float64
-	Str            string
-	Boolean        bool
-	Array          []Value
-	Function       Func
-	NativeFunction func([]Value) (Value, error)
+	Type     ValueType
+	Number   float64
+	Str      string
+	Boolean  bool
+	Array    []Value
+	Map      *OrderedMap
+	Struct   *StructType
+	Record   *RecordValue // also set on a method bound to the record
+	Module   *ModuleFile
+	Function Func
+	// NativeFunction is called with the environment of the call site.
+	NativeFunction func(env *Environment, args []Value) (Value, error)
 }
 
 func (v Value) String() string {
@@ -124,6 +349,14 @@ func (v Value) String() string {
 		return "fn"
 	case NativeFunction:
 		return "nativeFn"
+	case Map:
+		return v.Map.String()
+	case Struct:
+		return v.Struct.String()
+	case Record:
+		return v.Record.String()
+	case Module:
+		return v.Module.String()
 	default:
 		return "Unknown value type"
 	}
@@ -139,6 +372,8 @@ func (v Value) AsBoolean() bool {
 		return v.Boolean
 	case Array:
 		return len(v.Array) > 0
+	case Map:
+		return v.Map.Len() > 0
 	case String:
 		return len(v.Str) > 0
 	default:
@@ -147,6 +382,67 @@ func (v Value) AsBoolean() bool {
 }
 
 type Func struct {
+	// Name is the name the function was declared with, or "<func>" for a
+	// function literal.
+	Name     string
 	ArgNames []string
 	Body     []Statement
+	// Env is the environment the function was defined in. Calls create
+	// their frame as a child of it, so the body sees its enclosing locals.
+	Env *Environment
+	// Closure is the bytecode VM's representation of the function. It is
+	// nil for functions created by the tree-walking interpreter.
+	Closure any
+	// slots is the size of the function's frame, as counted by Resolve.
+	slots int
+	// decl is the statement or literal that created the function, which
+	// together with Env tells apart the functions created by the
+	// tree-walking interpreter.
+	decl Node
+}
+
+// same reports whether f and g are the same function: created by the same
+// evaluation of a declaration or literal.
+func (f Func) same(g Func) bool {
+	if f.Closure != nil || g.Closure != nil {
+		return f.Closure == g.Closure
+	}
+	return f.decl == g.decl && f.Env == g.Env
+}
+
+// Call runs a function created by the tree-walking interpreter, with env
+// supplying its globals. The caller is responsible for passing the right
+// number of arguments.
+func (f Func) Call(env *Environment, args []Value) (Value, error) {
+	frame := newCallFrame(f, env)
+	frame.values = append(frame.values, args...)
+	if b := env.Budget(); b != nil {
+		if err := b.Enter(); err != nil {
+			return Value{}, err
+		}
+		defer b.Leave()
+	}
+	return f.run(frame)
+}
+
+// module returns the module f was defined in, or nil for a function of
+// the main program.
+func (f Func) module() *ModuleFile {
+	if f.Env == nil {
+		return nil
+	}
+	return f.Env.globals.module
+}
+
+func (f Func) run(env *Environment) (Value, error) {
+	for _, s := range f.Body {
+		err := execute(s, env)
+		var ret *ReturnSignal
+		if errors.As(err, &ret) {
+			return ret.Value, nil
+		} else if err != nil {
+			return Value{}, err
+		}
+	}
+	return Value{}, nil
 }
@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorType is the type of the records a catch clause receives for errors
+// raised by the interpreter itself, such as a division by zero.
+var ErrorType = NewStructType("Error", []string{"message", "line", "column"})
+
+// Throw returns the error a throw statement n raises for value. Thrown
+// Error records keep their message, so a caught error can be rethrown.
+func Throw(n Node, value Value) error {
+	msg := fmt.Sprintf("uncaught exception: %s", value)
+	if value.Type == Record && value.Record.Type == ErrorType {
+		msg = value.Record.Fields[0].String()
+	}
+	return &RuntimeError{Msg: msg, Token: n.GetToken(), Span: n.Span(), Thrown: &value}
+}
+
+// Catchable reports whether a try statement handles err. Runtime errors
+// are caught, but not the errors that stop a program for exceeding its
+// limits or being canceled, nor the signals of return, break and continue.
+func Catchable(err error) bool {
+	var runtimeErr *RuntimeError
+	return errors.As(err, &runtimeErr) && !isLimitError(err)
+}
+
+// Caught returns the value a catch clause running in env binds for err:
+// the value thrown, or an Error record describing an error raised by the
+// interpreter.
+func Caught(env *Environment, err error) (Value, bool) {
+	var runtimeErr *RuntimeError
+	if !Catchable(err) || !errors.As(err, &runtimeErr) {
+		return Value{}, false
+	}
+	if runtimeErr.Thrown != nil {
+		return *runtimeErr.Thrown, true
+	}
+	pos := env.FileSet().Position(runtimeErr.Start)
+	return ErrorType.Construct([]Value{
+		{Type: String, Str: runtimeErr.Msg},
+		{Type: Number, Number: float64(pos.Line)},
+		{Type: Number, Number: float64(pos.Column)},
+	}), true
+}
+
+// isSignal reports whether err is the signal of a return, break or continue
+// statement.
+func isSignal(err error) bool {
+	var ret *ReturnSignal
+	var brk *BreakSignal
+	var cont *ContinueSignal
+	return errors.As(err, &ret) || errors.As(err, &brk) || errors.As(err, &cont)
+}
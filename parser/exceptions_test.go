@@ -0,0 +1,15 @@
+package parser
+
+import "testing"
+
+func TestTryCatchFinally(t *testing.T) {
+	expectOutput(t, `try { throw "boom" } catch e { print("caught", e) } finally { print("finally") }`, "caught boom\nfinally\n")
+	expectOutput(t, `func f { try { return 1 } finally { print("cleanup") } }
+print(f())`, "cleanup\n1.000000\n")
+	expectOutput(t, `for i in 0..3 { try { if i == 1 { continue }
+    print(i) } finally { print("f", i) } }`, "0.000000\nf 0.000000\nf 1.000000\n2.000000\nf 2.000000\n")
+	expectOutput(t, `try { try { throw 1 } finally { print("inner") } } catch e { print("outer", e) }`, "inner\nouter 1.000000\n")
+	expectOutput(t, `try { 1 / 0 } catch e { print(e.message, e.line, e.column) }`, "division by zero 1.000000 9.000000\n")
+	expectOutput(t, `try { throw 1 } catch { print("no variable") }`, "no variable\n")
+	expectError(t, `throw "uncaught"`, "uncaught")
+}
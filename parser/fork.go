@@ -0,0 +1,211 @@
+package parser
+
+// ForkableClosure is implemented by the Closure of a function compiled for
+// the bytecode VM, which keeps the locals it captures itself.
+type ForkableClosure interface {
+	// Captures reports whether the closure holds state a fork must copy:
+	// captured locals, or the globals of the module it belongs to.
+	Captures() bool
+	// Fork returns a copy of the closure whose state is copied with c.
+	Fork(c *Copier) any
+}
+
+// Copier copies the values of an environment being snapshotted or forked.
+// Each container, captured scope and module is copied once, so values that
+// share one in the original share its copy.
+type Copier struct {
+	// program is the global scope the copied modules belong to.
+	program *Environment
+	seen    map[any]any
+}
+
+func newCopier(program *Environment) *Copier {
+	return &Copier{program: program, seen: make(map[any]any)}
+}
+
+// Seen returns the copy made of orig, if it has been copied.
+func (c *Copier) Seen(orig any) (any, bool) {
+	copied, ok := c.seen[orig]
+	return copied, ok
+}
+
+// Remember records copied as the copy of orig. It must be called before
+// copying what orig holds, which may refer back to it.
+func (c *Copier) Remember(orig, copied any) {
+	c.seen[orig] = copied
+}
+
+// Value returns a copy of v that shares no mutable state with it.
+func (c *Copier) Value(v Value) Value {
+	switch v.Type {
+	case Array:
+		v.Array = c.array(v.Array)
+	case Map:
+		v.Map = c.orderedMap(v.Map)
+	case Struct:
+		v.Struct = c.structType(v.Struct)
+	case Module:
+		v.Module = c.Module(v.Module)
+	case Record, Function:
+		// A bound method carries the record it was read from.
+		if v.Record != nil {
+			v.Record = c.record(v.Record)
+		}
+		if v.Type == Function {
+			v.Function = c.function(v.Function)
+		}
+	}
+	return v
+}
+
+func (c *Copier) array(elems []Value) []Value {
+	if len(elems) == 0 {
+		return make([]Value, 0)
+	}
+	if copied, ok := c.seen[&elems[0]]; ok {
+		return copied.([]Value)
+	}
+	copied := make([]Value, len(elems))
+	c.seen[&elems[0]] = copied
+	for i, elem := range elems {
+		copied[i] = c.Value(elem)
+	}
+	return copied
+}
+
+func (c *Copier) orderedMap(m *OrderedMap) *OrderedMap {
+	if copied, ok := c.seen[m]; ok {
+		return copied.(*OrderedMap)
+	}
+	return m.copy(c)
+}
+
+func (c *Copier) record(r *RecordValue) *RecordValue {
+	if copied, ok := c.seen[r]; ok {
+		return copied.(*RecordValue)
+	}
+	return r.copy(c)
+}
+
+// structType returns t, or a copy of it if its methods capture state.
+func (c *Copier) structType(t *StructType) *StructType {
+	if copied, ok := c.seen[t]; ok {
+		return copied.(*StructType)
+	}
+	if !t.captures() {
+		return t
+	}
+	copied := &StructType{Name: t.Name, Fields: t.Fields, index: t.index, methods: make(map[string]Func, len(t.methods))}
+	c.seen[t] = copied
+	for name, method := range t.methods {
+		copied.methods[name] = c.function(method)
+	}
+	return copied
+}
+
+func (c *Copier) function(f Func) Func {
+	if cl, ok := f.Closure.(ForkableClosure); ok {
+		f.Closure = cl.Fork(c)
+		return f
+	}
+	f.Env = c.env(f.Env)
+	return f
+}
+
+// env returns a copy of the scope a function was defined in. Global scopes
+// are kept, since calls use the globals of their caller, except those of
+// modules, which are copied with their module.
+func (c *Copier) env(e *Environment) *Environment {
+	if e == nil {
+		return nil
+	}
+	if e.globals == e {
+		if e.module != nil {
+			return c.Module(e.module).Env
+		}
+		return e
+	}
+	if copied, ok := c.seen[e]; ok {
+		return copied.(*Environment)
+	}
+	copied := &Environment{values: make([]Value, len(e.values), cap(e.values))}
+	c.seen[e] = copied
+	copied.parent = c.env(e.parent)
+	copied.globals = c.env(e.globals)
+	for i, value := range e.values {
+		copied.values[i] = c.Value(value)
+	}
+	return copied
+}
+
+// Module returns a copy of m, with a copy of its globals, loaded for the
+// global scope the copier copies into.
+func (c *Copier) Module(m *ModuleFile) *ModuleFile {
+	if m == nil {
+		return nil
+	}
+	if copied, ok := c.seen[m]; ok {
+		return copied.(*ModuleFile)
+	}
+	copied := &ModuleFile{
+		Path:      m.Path,
+		File:      m.File,
+		Stmts:     m.Stmts,
+		exports:   m.exports,
+		program:   c.program,
+		evaluated: m.evaluated,
+		failed:    m.failed,
+	}
+	c.seen[m] = copied
+	copied.Env = NewEnvironment(c.program)
+	copied.Env.module = copied
+	for name, value := range m.Env.variables {
+		copied.Env.variables[name] = c.Value(value)
+	}
+	return copied
+}
+
+// modules returns copies of the modules a program has loaded.
+func (c *Copier) modules(modules map[string]*ModuleFile) map[string]*ModuleFile {
+	if modules == nil {
+		return nil
+	}
+	copied := make(map[string]*ModuleFile, len(modules))
+	for key, m := range modules {
+		copied[key] = c.Module(m)
+	}
+	return copied
+}
+
+// mutable reports whether forks must copy v: an array, map or record,
+// which could be modified in place, a module, whose globals could be, or a
+// function or struct whose methods capture state of their own.
+func mutable(v Value) bool {
+	switch v.Type {
+	case Array, Map, Record, Module:
+		return true
+	case Function:
+		return v.Record != nil || v.Function.captures()
+	case Struct:
+		return v.Struct.captures()
+	}
+	return false
+}
+
+// captures reports whether f holds state beyond the globals of its caller:
+// the locals of the scopes it was defined in, or the globals of its module.
+func (f Func) captures() bool {
+	if cl, ok := f.Closure.(ForkableClosure); ok {
+		return cl.Captures()
+	}
+	return f.Env != nil && (f.Env.globals != f.Env || f.Env.module != nil)
+}
+
+func (t *StructType) captures() bool {
+	for _, method := range t.methods {
+		if method.captures() {
+			return true
+		}
+	}
+	return false
+}
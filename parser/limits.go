@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Limits caps the resources a program may use in a single run. Zero fields
+// are unlimited.
+type Limits struct {
+	// Steps caps the statements executed, counting every evaluation of a
+	// loop condition.
+	Steps int
+	// Depth caps the number of nested function calls.
+	Depth int
+	// ArrayElements caps the total number of elements in arrays created by
+	// the program.
+	ArrayElements int
+}
+
+type CanceledError struct {
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("execution canceled: %v", e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+type StepLimitError struct {
+	Limit int
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("step limit of %d exceeded", e.Limit)
+}
+
+type DepthLimitError struct {
+	Limit int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("call depth limit of %d exceeded", e.Limit)
+}
+
+type AllocationLimitError struct {
+	Limit int
+}
+
+func (e *AllocationLimitError) Error() string {
+	return fmt.Sprintf("array allocation limit of %d elements exceeded", e.Limit)
+}
+
+// isLimitError reports whether err stopped a program for exceeding its
+// limits or being canceled. Scripts cannot catch these.
+func isLimitError(err error) bool {
+	var canceled *CanceledError
+	var steps *StepLimitError
+	var depth *DepthLimitError
+	var allocation *AllocationLimitError
+	return errors.As(err, &canceled) || errors.As(err, &steps) || errors.As(err, &depth) || errors.As(err, &allocation)
+}
+
+// Budget tracks a run against a context and its limits. Both engines
+// count steps the same way, so a program stops at the same point on
+// either.
+type Budget struct {
+	ctx       context.Context
+	limits    Limits
+	steps     int
+	depth     int
+	allocated int
+}
+
+func NewBudget(ctx context.Context, limits Limits) *Budget {
+	return &Budget{ctx: ctx, limits: limits}
+}
+
+// cancelCheckInterval is how many steps pass between checks of the
+// context, which are too slow to make on every step.
+const cancelCheckInterval = 256
+
+func (b *Budget) Step() error {
+	b.steps++
+	if b.limits.Steps > 0 && b.steps > b.limits.Steps {
+		return &StepLimitError{Limit: b.limits.Steps}
+	}
+	if b.steps%cancelCheckInterval == 1 {
+		if err := b.ctx.Err(); err != nil {
+			return &CanceledError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Enter records a function call, which must be matched by Leave once it
+// returns.
+func (b *Budget) Enter() error {
+	if b.limits.Depth > 0 && b.depth >= b.limits.Depth {
+		return &DepthLimitError{Limit: b.limits.Depth}
+	}
+	b.depth++
+	return nil
+}
+
+func (b *Budget) Leave() {
+	b.depth--
+}
+
+// Allocate records the creation of an array of n elements.
+func (b *Budget) Allocate(n int) error {
+	b.allocated += n
+	if b.limits.ArrayElements > 0 && b.allocated > b.limits.ArrayElements {
+		return &AllocationLimitError{Limit: b.limits.ArrayElements}
+	}
+	return nil
+}
+
+// SetBudget makes programs running in env's global scope count against b.
+// A nil budget removes the limits.
+func (env *Environment) SetBudget(b *Budget) {
+	env.globals.budget = b
+}
+
+func (env *Environment) Budget() *Budget {
+	return env.program().budget
+}
+
+// step counts the execution of n against the run's budget, if it has one.
+func (env *Environment) step(n Node) error {
+	if b := env.Budget(); b != nil {
+		if err := b.Step(); err != nil {
+			return WrapRuntimeError(n, err)
+		}
+	}
+	return nil
+}
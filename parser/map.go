@@ -0,0 +1,204 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OrderedMap holds the entries of a Map value. It remembers the order its
+// keys were first inserted in, so iterating over it is deterministic. Keys
+// are numbers, strings or booleans. Like arrays, maps are shared by
+// reference.
+type OrderedMap struct {
+	entries []mapEntry
+	// index maps each key to its position in entries.
+	index map[mapKey]int
+}
+
+type mapEntry struct {
+	key   Value
+	value Value
+}
+
+// mapKey is the comparable form of a key.
+type mapKey struct {
+	typ ValueType
+	num float64
+	str string
+}
+
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{index: make(map[mapKey]int)}
+}
+
+func keyOf(v Value) (mapKey, error) {
+	switch v.Type {
+	case Number:
+		return mapKey{typ: Number, num: v.Number}, nil
+	case String:
+		return mapKey{typ: String, str: v.Str}, nil
+	case Boolean:
+		if v.Boolean {
+			return mapKey{typ: Boolean, num: 1}, nil
+		}
+		return mapKey{typ: Boolean}, nil
+	default:
+		return mapKey{}, fmt.Errorf("invalid map key type: %s", v.Type)
+	}
+}
+
+func (m *OrderedMap) Len() int {
+	return len(m.entries)
+}
+
+func (m *OrderedMap) Get(key Value) (Value, bool, error) {
+	k, err := keyOf(key)
+	if err != nil {
+		return Value{}, false, err
+	}
+	i, ok := m.index[k]
+	if !ok {
+		return Value{}, false, nil
+	}
+	return m.entries[i].value, true, nil
+}
+
+// Set stores value under key. A new key goes after the existing ones; an
+// existing key keeps its place.
+func (m *OrderedMap) Set(key, value Value) error {
+	k, err := keyOf(key)
+	if err != nil {
+		return err
+	}
+	if i, ok := m.index[k]; ok {
+		m.entries[i].value = value
+		return nil
+	}
+	m.index[k] = len(m.entries)
+	m.entries = append(m.entries, mapEntry{key: key, value: value})
+	return nil
+}
+
+// Delete removes key, reporting whether it was present.
+func (m *OrderedMap) Delete(key Value) (bool, error) {
+	k, err := keyOf(key)
+	if err != nil {
+		return false, err
+	}
+	i, ok := m.index[k]
+	if !ok {
+		return false, nil
+	}
+	delete(m.index, k)
+	m.entries = append(m.entries[:i], m.entries[i+1:]...)
+	for j := i; j < len(m.entries); j++ {
+		k, _ := keyOf(m.entries[j].key)
+		m.index[k] = j
+	}
+	return true, nil
+}
+
+func (m *OrderedMap) Keys() []Value {
+	keys := make([]Value, len(m.entries))
+	for i, e := range m.entries {
+		keys[i] = e.key
+	}
+	return keys
+}
+
+func (m *OrderedMap) Values() []Value {
+	values := make([]Value, len(m.entries))
+	for i, e := range m.entries {
+		values[i] = e.value
+	}
+	return values
+}
+
+// Entry returns the key and value at position i in insertion order.
+func (m *OrderedMap) Entry(i int) (Value, Value) {
+	return m.entries[i].key, m.entries[i].value
+}
+
+func (m *OrderedMap) String() string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, e := range m.entries {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %s", e.key, e.value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// copy returns a copy of m whose values are copied with c.
+func (m *OrderedMap) copy(c *Copier) *OrderedMap {
+	copied := &OrderedMap{entries: make([]mapEntry, len(m.entries)), index: make(map[mapKey]int, len(m.index))}
+	c.Remember(m, copied)
+	for i, e := range m.entries {
+		copied.entries[i] = mapEntry{key: e.key, value: c.Value(e.value)}
+	}
+	for k, i := range m.index {
+		copied.index[k] = i
+	}
+	return copied
+}
+
+// mapArgs checks the arguments of a map builtin: a map followed by n more
+// values.
+func mapArgs(name string, vs []Value, n int) (*OrderedMap, error) {
+	if len(vs) != n+1 {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, n+1, len(vs))
+	}
+	if vs[0].Type != Map {
+		return nil, fmt.Errorf("%s expects a Map, got %s", name, vs[0].Type)
+	}
+	return vs[0].Map, nil
+}
+
+func mapKeys(env *Environment, vs []Value) (Value, error) {
+	m, err := mapArgs("keys", vs, 0)
+	if err != nil {
+		return Value{}, err
+	}
+	return allocateArray(env, m.Keys())
+}
+
+func mapValues(env *Environment, vs []Value) (Value, error) {
+	m, err := mapArgs("values", vs, 0)
+	if err != nil {
+		return Value{}, err
+	}
+	return allocateArray(env, m.Values())
+}
+
+// allocateArray charges the elements of a new array to env's budget, as an
+// array literal does, and returns the array.
+func allocateArray(env *Environment, elems []Value) (Value, error) {
+	if b := env.Budget(); b != nil {
+		if err := b.Allocate(len(elems)); err != nil {
+			return Value{}, err
+		}
+	}
+	return Value{Type: Array, Array: elems}, nil
+}
+
+func mapHas(env *Environment, vs []Value) (Value, error) {
+	m, err := mapArgs("has", vs, 1)
+	if err != nil {
+		return Value{}, err
+	}
+	_, ok, err := m.Get(vs[1])
+	return Value{Type: Boolean, Boolean: ok}, err
+}
+
+// mapDelete removes a key from a map, returning whether it was present.
+func mapDelete(env *Environment, vs []Value) (Value, error) {
+	m, err := mapArgs("delete", vs, 1)
+	if err != nil {
+		return Value{}, err
+	}
+	ok, err := m.Delete(vs[1])
+	return Value{Type: Boolean, Boolean: ok}, err
+}
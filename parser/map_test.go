@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMapBuiltins(t *testing.T) {
+	expectOutput(t, `let m := {"a": 1, "b": 2}
+m["c"] = 3
+m["a"] = 0
+print(m)
+print(keys(m), values(m))
+print(has(m, "b"), delete(m, "b"), has(m, "b"), delete(m, "b"))
+for k, v in m { print(k, v) }`, `{a: 0.000000, b: 2.000000, c: 3.000000}
+[a b c] [0.000000 2.000000 3.000000]
+true true false false
+a 0.000000
+c 3.000000
+`)
+	expectError(t, `let m := {}
+m["missing"]`, "key not found: missing")
+	expectError(t, `let m := {[1]: 2}`, "invalid map key type: Array")
+	expectError(t, `keys([1])`, "keys expects a Map, got Array")
+}
+
+func TestKeysAndValuesAreAllocations(t *testing.T) {
+	for _, builtin := range []string{"keys", "values"} {
+		env := NewDefaultEnvironment()
+		file := env.FileSet().AddFile("test.tiny", "let m := {1: 1, 2: 2, 3: 3}\n"+builtin+"(m)")
+		stmts := parse(t, file)
+		if err := Resolve(stmts, env); err != nil {
+			t.Fatal(err)
+		}
+		env.SetBudget(NewBudget(t.Context(), Limits{ArrayElements: 2}))
+		_, err := Run(stmts, env)
+		var limit *AllocationLimitError
+		if !errors.As(err, &limit) {
+			t.Errorf("%s of 3 entries with room for 2 elements: got %v, want an AllocationLimitError", builtin, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/printchard/tiny-lang/lexer"
+)
+
+// ModuleFile is a file imported by a program. However many files import
+// it, a module is loaded and its top level run once per program, in a
+// global scope of its own on top of the program's. It sees the builtins
+// and the globals the program has defined by the time it loads the module,
+// such as the functions the host registered, but cannot assign to them.
+// The files importing it only see the names it exports.
+type ModuleFile struct {
+	// Path is the module's file, joined to the directory of the file that
+	// first imported it.
+	Path string
+	// File holds the module's source, in the FileSet of the program.
+	File  *lexer.File
+	Stmts []Statement
+	// Env holds the module's globals.
+	Env *Environment
+	// exports holds the names the module declares with export.
+	exports map[string]bool
+	// program is the global scope of the program that loaded the module.
+	// It supplies the module's I/O streams and budget, and the globals of
+	// the program's functions when the module calls them back.
+	program *Environment
+	loading bool
+	// evaluated is set once the module's top level has started running,
+	// and failed if it raised an error.
+	evaluated bool
+	failed    bool
+}
+
+func (m *ModuleFile) String() string {
+	return "module " + m.Path
+}
+
+// Export returns the value of the exported global name.
+func (m *ModuleFile) Export(name string) (Value, bool) {
+	if !m.exports[name] {
+		return Value{}, false
+	}
+	return m.Env.Get(name)
+}
+
+// Evaluate runs m's top level with run, unless an earlier import has
+// already run it. A return statement at the top level ends the module.
+// Errors are reported as unwinding through the import statement n, and a
+// module that failed fails every later import of it too.
+func (m *ModuleFile) Evaluate(n Node, run func() error) error {
+	if m.failed {
+		return NewRuntimeError(n, fmt.Sprintf("%s failed to run", m))
+	}
+	if m.evaluated {
+		return nil
+	}
+	m.evaluated = true
+	err := run()
+	var ret *ReturnSignal
+	if err == nil || errors.As(err, &ret) {
+		return nil
+	}
+	m.failed = true
+	return AddStackFrame(err, "<module>", n)
+}
+
+// loader is the state shared by the resolvers of a program and of the
+// modules it imports.
+type loader struct {
+	// program is the global scope the modules are loaded for.
+	program *Environment
+	// importing are the modules being loaded, outermost first.
+	importing []*ModuleFile
+	// failed holds the modules found to have errors, so that importing one
+	// again does not report them twice.
+	failed map[string]bool
+}
+
+// load returns the module s imports, loading it unless the program already
+// has. Paths are relative to the directory of the importing file. Problems
+// in the module are reported with the importing file's, and leave s
+// without a module.
+func (r *resolver) load(s *ImportStatement) *ModuleFile {
+	path := s.Path.Value
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.dir, path)
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		r.report(s.Path, fmt.Sprintf("cannot import %s: %v", s.Path.Value, err))
+		return nil
+	}
+	if r.loader.failed[key] {
+		return nil
+	}
+	program := r.loader.program
+	if m, ok := program.modules[key]; ok {
+		if m.loading {
+			var cycle []string
+			for i := len(r.loader.importing) - 1; i >= 0; i-- {
+				cycle = append([]string{r.loader.importing[i].Path}, cycle...)
+				if r.loader.importing[i] == m {
+					break
+				}
+			}
+			r.report(s.Path, fmt.Sprintf("import cycle: %s -> %s", strings.Join(cycle, " -> "), m.Path))
+			return nil
+		}
+		return m
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		r.report(s.Path, fmt.Sprintf("cannot import %s: %v", s.Path.Value, err))
+		return nil
+	}
+	file := program.FileSet().AddFile(path, string(src))
+	m := &ModuleFile{Path: path, File: file, exports: make(map[string]bool), program: program, loading: true}
+	m.Env = NewEnvironment(program)
+	m.Env.module = m
+	if program.modules == nil {
+		program.modules = make(map[string]*ModuleFile)
+	}
+	program.modules[key] = m
+	r.loader.importing = append(r.loader.importing, m)
+	diags := r.compile(m)
+	r.loader.importing = r.loader.importing[:len(r.loader.importing)-1]
+	m.loading = false
+
+	r.diagnostics = append(r.diagnostics, diags...)
+	if diags.HasErrors() {
+		delete(program.modules, key)
+		r.loader.failed[key] = true
+		return nil
+	}
+	for _, stmt := range m.Stmts {
+		if export, ok := stmt.(*ExportStatement); ok {
+			m.exports[export.Name().String()] = true
+		}
+	}
+	return m
+}
+
+// compile lexes, parses and resolves the source of m, returning every
+// problem found.
+func (r *resolver) compile(m *ModuleFile) lexer.Diagnostics {
+	tokens, lexErr := lexer.New(m.File).Tokenize()
+	var diags lexer.Diagnostics
+	if lexErr != nil {
+		diags = append(diags, lexErr.(lexer.Diagnostics)...)
+	}
+	p := New(m.File, tokens)
+	stmts, parseErr := p.Parse()
+	diags = append(diags, p.Diagnostics()...)
+	if lexErr != nil || parseErr != nil {
+		return diags
+	}
+	m.Stmts = stmts
+	module := &resolver{env: m.Env, dir: filepath.Dir(m.Path), loader: r.loader}
+	return append(diags, module.resolve(stmts)...)
+}
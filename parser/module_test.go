@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/printchard/tiny-lang/lexer"
+)
+
+// writeModules writes each source to the file of that name in a new
+// directory, which it returns.
+func writeModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.ToSlash(dir) + "/"
+}
+
+func TestImports(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"math.tiny": `import { twice } from "util.tiny"
+print("loading math")
+export let pi := 3
+export func square: x { return x * x }
+export func sixfold: x { return twice(x) * 3 }
+let hidden := 1`,
+		"util.tiny": `export func twice: x { return x * 2 }`,
+	})
+	expectOutput(t, `import "`+dir+`math.tiny"
+import "`+dir+`math.tiny" as m
+import { square, pi as PI } from "`+dir+`math.tiny"
+print(math.pi, m.square(3), square(4), PI, math.sixfold(1))`, "loading math\n3.000000 9.000000 16.000000 3.000000 6.000000\n")
+	expectError(t, `import { hidden } from "`+dir+`math.tiny"`, "does not export hidden")
+	expectError(t, `import "`+dir+`math.tiny"
+math.pi = 4`, "cannot assign to pi of module")
+	expectError(t, `import "`+dir+`missing.tiny"`, "cannot import")
+}
+
+func TestImportCycles(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"a.tiny": `import "b.tiny"`,
+		"b.tiny": `import "a.tiny"`,
+	})
+	expectError(t, `import "`+dir+`a.tiny"`, "import cycle: "+dir+"a.tiny -> "+dir+"b.tiny -> "+dir+"a.tiny")
+}
+
+func TestModuleErrorsNameTheirFile(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"bad.tiny":    "export func f {\n  return 1 - \"a\"\n}",
+		"syntax.tiny": "let := 1",
+	})
+	for _, tc := range []struct {
+		src, want string
+	}{
+		{`import { f } from "` + dir + `bad.tiny"
+f()`, dir + "bad.tiny:2"},
+		{`import "` + dir + `syntax.tiny"`, dir + "syntax.tiny:1"},
+	} {
+		env := NewDefaultEnvironment()
+		file := env.FileSet().AddFile("main.tiny", tc.src)
+		tokens, err := lexer.New(file).Tokenize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = New(file, tokens).Execute(env)
+		var runtimeErr *RuntimeError
+		var diags lexer.Diagnostics
+		var at lexer.Pos
+		switch {
+		case errors.As(err, &runtimeErr):
+			at = runtimeErr.Start
+		case errors.As(err, &diags) && len(diags) > 0:
+			at = diags[0].Pos()
+		default:
+			t.Errorf("running %q: got %v, want an error located in the module", tc.src, err)
+			continue
+		}
+		pos := env.FileSet().Position(at)
+		if got := fmt.Sprintf("%s:%d", filepath.ToSlash(pos.Filename), pos.Line); got != tc.want {
+			t.Errorf("running %q: error at %s, want %s", tc.src, got, tc.want)
+		}
+	}
+}
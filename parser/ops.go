@@ -0,0 +1,292 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/printchard/tiny-lang/lexer"
+)
+
+// The operations below define the semantics of tiny-lang's operators. They
+// are shared by the tree-walking interpreter and the bytecode VM; errors are
+// plain messages that callers attach to the offending node.
+
+func BinaryOp(op lexer.TokenType, left, right Value) (Value, error) {
+	if left.Type != right.Type {
+		return Value{}, fmt.Errorf("type mismatch: %s and %s", left.Type, right.Type)
+	}
+
+	switch left.Type {
+	case Number:
+		switch op {
+		case lexer.PlusToken:
+			return Value{Type: Number, Number: left.Number + right.Number}, nil
+		case lexer.MinusToken:
+			return Value{Type: Number, Number: left.Number - right.Number}, nil
+		case lexer.MultiplyToken:
+			return Value{Type: Number, Number: left.Number * right.Number}, nil
+		case lexer.DivideToken:
+			if right.Number == 0 {
+				return Value{}, fmt.Errorf("division by zero")
+			}
+			return Value{Type: Number, Number: left.Number / right.Number}, nil
+		case lexer.EqualToken:
+			return Value{Type: Boolean, Boolean: left.Number == right.Number}, nil
+		case lexer.NotEqualToken:
+			return Value{Type: Boolean, Boolean: left.Number != right.Number}, nil
+		case lexer.LTToken:
+			return Value{Type: Boolean, Boolean: left.Number < right.Number}, nil
+		case lexer.LEQToken:
+			return Value{Type: Boolean, Boolean: left.Number <= right.Number}, nil
+		case lexer.GTToken:
+			return Value{Type: Boolean, Boolean: left.Number > right.Number}, nil
+		case lexer.GEQToken:
+			return Value{Type: Boolean, Boolean: left.Number >= right.Number}, nil
+		default:
+			return Value{}, fmt.Errorf("unknown operator: %s", op)
+		}
+	case String:
+		switch op {
+		case lexer.PlusToken:
+			return Value{Type: String, Str: left.Str + right.Str}, nil
+		case lexer.EqualToken:
+			return Value{Type: Boolean, Boolean: left.Str == right.Str}, nil
+		case lexer.NotEqualToken:
+			return Value{Type: Boolean, Boolean: left.Str != right.Str}, nil
+		default:
+			return Value{}, fmt.Errorf("unknown operator for strings: %s", op)
+		}
+	default:
+		bLeft, bRight := left.AsBoolean(), right.AsBoolean()
+		switch op {
+		case lexer.EqualToken, lexer.NotEqualToken:
+			eq, err := equal(left, right)
+			if err != nil {
+				return Value{}, err
+			}
+			return Value{Type: Boolean, Boolean: eq == (op == lexer.EqualToken)}, nil
+		case lexer.AndToken:
+			return Value{Type: Boolean, Boolean: bLeft && bRight}, nil
+		case lexer.OrToken:
+			return Value{Type: Boolean, Boolean: bLeft || bRight}, nil
+		default:
+			return Value{}, fmt.Errorf("unsupported types for binary operations: %s, %s", left.Type, right.Type)
+		}
+	}
+}
+
+// equal compares two values of the same type other than numbers and
+// strings. Arrays, maps, records, structs, modules and functions are shared
+// by reference, so they are equal only if they are the same one; all empty
+// arrays are the same. Native functions cannot be compared.
+func equal(left, right Value) (bool, error) {
+	switch left.Type {
+	case Void:
+		return true, nil
+	case Boolean:
+		return left.Boolean == right.Boolean, nil
+	case Array:
+		return len(left.Array) == len(right.Array) && (len(left.Array) == 0 || &left.Array[0] == &right.Array[0]), nil
+	case Map:
+		return left.Map == right.Map, nil
+	case Struct:
+		return left.Struct == right.Struct, nil
+	case Record:
+		return left.Record == right.Record, nil
+	case Module:
+		return left.Module == right.Module, nil
+	case Function:
+		// A method is bound to the record it was read from.
+		return left.Record == right.Record && left.Function.same(right.Function), nil
+	default:
+		return false, fmt.Errorf("cannot compare %s values", left.Type)
+	}
+}
+
+func UnaryOp(op lexer.TokenType, value Value) (Value, error) {
+	switch value.Type {
+	case Number:
+		switch op {
+		case lexer.MinusToken:
+			return Value{Type: Number, Number: -value.Number}, nil
+		default:
+			return Value{}, fmt.Errorf("unknown unary operator: %s", op)
+		}
+	default:
+		switch op {
+		case lexer.NotToken:
+			return Value{Type: Boolean, Boolean: !value.AsBoolean()}, nil
+		default:
+			return Value{}, fmt.Errorf("unknown unary operator for boolean: %s", op)
+		}
+	}
+}
+
+// Index reads left[index]. Reading a key missing from a map is an error.
+func Index(left, index Value) (Value, error) {
+	if left.Type == Map {
+		value, ok, err := left.Map.Get(index)
+		if err != nil {
+			return Value{}, err
+		}
+		if !ok {
+			return Value{}, fmt.Errorf("key not found: %s", index)
+		}
+		return value, nil
+	}
+	if left.Type != Array {
+		return Value{}, fmt.Errorf("left side of postfix expression must be an array or map, got %s", left.Type)
+	}
+	if index.Type != Number {
+		return Value{}, fmt.Errorf("index must be a number, got %s", index.Type)
+	}
+	if int(index.Number) < 0 || int(index.Number) >= len(left.Array) {
+		return Value{}, fmt.Errorf("index out of bounds: %d", int(index.Number))
+	}
+	return left.Array[int(index.Number)], nil
+}
+
+// CheckIndexTarget reports whether left can be the target of an index
+// assignment. It is checked before the index and value are evaluated.
+func CheckIndexTarget(left Value) error {
+	if left.Type != Array && left.Type != Map {
+		return fmt.Errorf("left side of index assignment must be an array or map, got %s", left.Type)
+	}
+	return nil
+}
+
+// SetIndex performs left[index] = value on a target accepted by
+// CheckIndexTarget. Assigning to a key missing from a map adds it.
+func SetIndex(left, index, value Value) error {
+	if left.Type == Map {
+		return left.Map.Set(index, value)
+	}
+	if index.Type != Number {
+		return fmt.Errorf("index must be a number, got %s", index.Type)
+	}
+	if int(index.Number) < 0 || int(index.Number) >= len(left.Array) {
+		return fmt.Errorf("index out of bounds: %d", int(index.Number))
+	}
+	left.Array[int(index.Number)] = value
+	return nil
+}
+
+// GetField reads the named field of a record. Naming one of its methods
+// instead gives the method bound to the record. For a module, it reads
+// the current value of one of its exports.
+func GetField(v Value, name string) (Value, error) {
+	if v.Type == Module {
+		value, ok := v.Module.Export(name)
+		if !ok {
+			return Value{}, fmt.Errorf("%s does not export %s", v.Module, name)
+		}
+		return value, nil
+	}
+	if v.Type != Record {
+		return Value{}, fmt.Errorf("cannot read field %s of %s", name, v.Type)
+	}
+	if i, ok := v.Record.Type.Field(name); ok {
+		return v.Record.Fields[i], nil
+	}
+	if method, ok := v.Record.Type.Method(name); ok {
+		return v.Record.bind(method), nil
+	}
+	return Value{}, fmt.Errorf("%s has no field or method %s", v.Record.Type.Name, name)
+}
+
+// CheckFieldTarget reports whether the named field of v can be assigned
+// to. It is checked before the value is evaluated.
+func CheckFieldTarget(v Value, name string) error {
+	if v.Type == Module {
+		return fmt.Errorf("cannot assign to %s of %s", name, v.Module)
+	}
+	if v.Type != Record {
+		return fmt.Errorf("cannot assign to field %s of %s", name, v.Type)
+	}
+	if _, ok := v.Record.Type.Field(name); !ok {
+		if _, ok := v.Record.Type.Method(name); ok {
+			return fmt.Errorf("cannot assign to method %s of %s", name, v.Record.Type.Name)
+		}
+		return fmt.Errorf("%s has no field %s", v.Record.Type.Name, name)
+	}
+	return nil
+}
+
+// SetField stores value in the named field of a record accepted by
+// CheckFieldTarget.
+func SetField(v Value, name string, value Value) {
+	i, _ := v.Record.Type.Field(name)
+	v.Record.Fields[i] = value
+}
+
+// Concat joins the parts of an interpolated string.
+func Concat(parts []Value) Value {
+	var n int
+	for _, part := range parts {
+		n += len(part.Str)
+	}
+	str := make([]byte, 0, n)
+	for _, part := range parts {
+		if part.Type == String {
+			str = append(str, part.Str...)
+		} else {
+			str = append(str, part.String()...)
+		}
+	}
+	return Value{Type: String, Str: string(str)}
+}
+
+// ForSequence prepares the value a for loop iterates over: the elements of
+// an array, the characters of a string, the entries of a map in insertion
+// order, or with isRange set the numbers from v up to but not including
+// end.
+func ForSequence(v, end Value, isRange bool) (Value, error) {
+	if isRange {
+		if v.Type != Number || end.Type != Number {
+			return Value{}, fmt.Errorf("range bounds must be numbers, got %s and %s", v.Type, end.Type)
+		}
+		return v, nil
+	}
+	switch v.Type {
+	case Array:
+		return v, nil
+	case Map:
+		// The loop runs over the entries the map had when it started.
+		return Value{Type: Map, Map: &OrderedMap{entries: slices.Clone(v.Map.entries)}}, nil
+	case String:
+		var chars []Value
+		for _, r := range v.Str {
+			chars = append(chars, Value{Type: String, Str: string(r)})
+		}
+		return Value{Type: Array, Array: chars}, nil
+	default:
+		return Value{}, fmt.Errorf("cannot iterate over %s", v.Type)
+	}
+}
+
+// ForElement returns the index and element of iteration i of a loop over a
+// sequence prepared by ForSequence, or false once the loop is done. Array
+// elements are read as the loop reaches them, so it sees values its body
+// stores.
+//
+// For a map, the key takes the place of the index. A loop with a single
+// variable binds the element, or the key if it iterates over a map.
+func ForElement(seq, end Value, i int) (Value, Value, bool) {
+	index := Value{Type: Number, Number: float64(i)}
+	switch seq.Type {
+	case Number:
+		n := seq.Number + float64(i)
+		return index, Value{Type: Number, Number: n}, n < end.Number
+	case Map:
+		if i >= seq.Map.Len() {
+			return Value{}, Value{}, false
+		}
+		key, value := seq.Map.Entry(i)
+		return key, value, true
+	default:
+		if i >= len(seq.Array) {
+			return Value{}, Value{}, false
+		}
+		return index, seq.Array[i], true
+	}
+}
@@ -0,0 +1,28 @@
+package parser
+
+import "testing"
+
+func TestEquality(t *testing.T) {
+	expectOutput(t, `print(1 == 1, "a" != "b", true == true, void == void)`, "true true true true\n")
+	expectOutput(t, `struct Point { x, y }
+let p := Point(1, 2)
+print(p == Point(1, 2), p == p, p != Point(3, 4))`, "false true true\n")
+	expectOutput(t, `let m := {1: 2}
+let n := m
+print(m == {1: 2}, m == n, {} == {})`, "false true false\n")
+	expectOutput(t, `let a := [1]
+let b := a
+print(a == [1], a == b)`, "false true\n")
+	expectOutput(t, `func f { return 1 }
+func g { return 1 }
+let h := f
+func make { return func { return 1 } }
+print(f == g, f == h, make() == make())`, "false true false\n")
+	expectOutput(t, `struct Box { v
+  func get { return self.v } }
+let a := Box(1)
+let b := Box(1)
+print(a.get == a.get, a.get == b.get)`, "true false\n")
+	expectError(t, `print == print`, "cannot compare NativeFn values")
+	expectError(t, `1 == "1"`, "type mismatch: Number and String")
+}
@@ -2,31 +2,66 @@ package parser
 
 import (
 	"fmt"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/printchard/tiny-lang/lexer"
 )
 
 type Parser struct {
-	tokens  []lexer.Token
-	current int
+	// file is the file the tokens were lexed from.
+	file        *lexer.File
+	tokens      []lexer.Token
+	current     int
+	diagnostics lexer.Diagnostics
+	// loops holds the labels of the loops enclosing the statement being
+	// parsed, innermost last, with "" for an unlabeled loop.
+	loops []string
+	// end describes running out of tokens in error messages, when that is
+	// not the end of the file.
+	end string
 }
 
 type ParserError struct {
 	lexer.Token
-	Msg string
+	Msg   string
+	Level lexer.Severity
 }
 
 func (e *ParserError) Error() string {
-	return fmt.Sprintf("[Line :%d:%d]: %s", e.Token.Line, e.Token.Column, e.Msg)
+	return e.prefix() + e.Msg
 }
 
-func (e *ParserError) Format(fileName string) string {
-	return fmt.Sprintf("[%s:%d:%d]: %s", fileName, e.Token.Line, e.Token.Column, e.Msg)
+func (e *ParserError) Format(fset *lexer.FileSet) string {
+	pos := fset.Position(e.Start)
+	msg := fmt.Sprintf("[%s:%d:%d]: %s%s", pos.Filename, pos.Line, pos.Column, e.prefix(), e.Msg)
+	if excerpt := fset.File(e.Start).Underline(e.Token.Span(), e.Start); excerpt != "" {
+		msg += "\n" + excerpt
+	}
+	return msg
+}
+
+func (e *ParserError) Severity() lexer.Severity {
+	return e.Level
+}
+
+func (e *ParserError) Message() string {
+	return e.Msg
+}
+
+func (e *ParserError) prefix() string {
+	if e.Level == lexer.SeverityWarning {
+		return "warning: "
+	}
+	return ""
 }
 
-func New(tokens []lexer.Token) *Parser {
+// New returns a parser for tokens lexed from file.
+func New(file *lexer.File, tokens []lexer.Token) *Parser {
 	return &Parser{
+		file:   file,
 		tokens: tokens,
 	}
 }
@@ -45,20 +80,53 @@ func (p *Parser) peek() lexer.TokenType {
 
 func (p *Parser) peekToken() lexer.Token {
 	if p.current >= len(p.tokens) {
-		return lexer.Token{}
+		return p.eofToken()
 	}
 	return p.tokens[p.current]
 }
 
+// eofToken is a zero width token just past the last token, or at the end
+// of a file without tokens, so errors at the end of input still point into
+// the source.
+func (p *Parser) eofToken() lexer.Token {
+	end := p.file.Pos(p.file.Size())
+	if len(p.tokens) > 0 {
+		end = p.tokens[len(p.tokens)-1].End
+	}
+	return lexer.Token{Type: lexer.EOFToken, Literal: "EOF", Start: end, End: end}
+}
+
+// found describes the next token for error messages.
+func (p *Parser) found() string {
+	if p.current >= len(p.tokens) && p.end != "" {
+		return p.end
+	}
+	return p.peek().String()
+}
+
+// sameLine reports whether tokens a and b start on the same line.
+func (p *Parser) sameLine(a, b lexer.Token) bool {
+	return p.file.Line(a.Start) == p.file.Line(b.Start)
+}
+
+// startsLine reports whether the next token is on a later line than the
+// end of the one before it.
+func (p *Parser) startsLine() bool {
+	if p.current == 0 {
+		return true
+	}
+	return p.file.Line(p.tokens[p.current-1].End) < p.file.Line(p.peekToken().Start)
+}
+
 func (p *Parser) match(expected lexer.TokenType) error {
 	if p.current >= len(p.tokens) {
-		return p.error("unexpected EOF")
+		return p.error("unexpected " + p.found())
 	}
 	if p.peek() == expected {
 		p.current++
 		return nil
 	}
-	return p.error(fmt.Sprintf("expected %s, found %s", expected, p.peek()))
+	return p.error(fmt.Sprintf("expected %s, found %s", expected, p.found()))
 }
 
 func (p *Parser) unmatch() {
@@ -67,10 +135,53 @@ func (p *Parser) unmatch() {
 	}
 }
 
+// Parse parses the whole program. Errors in a statement are recorded and
+// parsing resumes at the next statement, so the returned error holds every
+// diagnostic found. Warnings alone do not make Parse fail; they are
+// available from Diagnostics.
 func (p *Parser) Parse() ([]Statement, error) {
-	return p.parseProgram()
+	stmts := p.parseProgram()
+	if p.diagnostics.HasErrors() {
+		return nil, p.diagnostics
+	}
+	return stmts, nil
+}
+
+// Diagnostics returns the errors and warnings reported by Parse.
+func (p *Parser) Diagnostics() lexer.Diagnostics {
+	return p.diagnostics
 }
 
+func (p *Parser) report(err error) {
+	if diag, ok := err.(lexer.Diagnostic); ok {
+		p.diagnostics = append(p.diagnostics, diag)
+	} else {
+		p.diagnostics = append(p.diagnostics, &ParserError{Msg: err.Error(), Token: p.peekToken()})
+	}
+}
+
+func (p *Parser) warn(tok lexer.Token, msg string) {
+	p.diagnostics = append(p.diagnostics, &ParserError{Msg: msg, Token: tok, Level: lexer.SeverityWarning})
+}
+
+// synchronize skips tokens after a parse error until the start of the next
+// statement or the end of the enclosing block.
+func (p *Parser) synchronize(start int) {
+	if p.current == start {
+		p.current++
+	}
+	for p.current < len(p.tokens) {
+		switch p.peek() {
+		case lexer.LetToken, lexer.IfToken, lexer.WhileToken, lexer.ForToken, lexer.StructToken, lexer.FunctionToken, lexer.ReturnToken, lexer.BreakToken, lexer.ContinueToken, lexer.ThrowToken, lexer.TryToken, lexer.ImportToken, lexer.ExportToken, lexer.RightBraceToken:
+			return
+		}
+		p.current++
+	}
+}
+
+// Execute parses the program, resolves it against env and runs it there,
+// as Run does. Its imports are relative to the directory of the parser's
+// file. A nil env runs the program in a new global scope.
 func (p *Parser) Execute(env *Environment) error {
 	if env == nil {
 		env = NewEnvironment(nil)
@@ -80,66 +191,208 @@ func (p *Parser) Execute(env *Environment) error {
 	if err != nil {
 		return err
 	}
-	for _, stmt := range stmts {
-		if err := stmt.Execute(env); err != nil {
-			return err
-		}
+	if diags := ResolveFile(stmts, env, p.file.Name()); diags.HasErrors() {
+		return diags
 	}
-	return nil
+	_, err = Run(stmts, env)
+	return err
 }
 
-func (p *Parser) parseProgram() ([]Statement, error) {
+func (p *Parser) parseProgram() []Statement {
 	statements := []Statement{}
 	for p.current < len(p.tokens) {
-		if p.peek() == lexer.EOFToken {
-			return nil, p.error("unexpected EOF")
+		if p.peek() == lexer.RightBraceToken {
+			p.report(p.error("unexpected }"))
+			p.current++
+			continue
 		}
-		stmt, err := p.parseStatement()
+		start := p.current
+		stmt, err := p.parseTopLevelStatement()
 		if err != nil {
-			return nil, err
+			p.report(err)
+			p.synchronize(start)
+			// A brace left over from the broken statement has already been
+			// accounted for by the error above.
+			if p.peek() == lexer.RightBraceToken {
+				p.current++
+			}
+			continue
 		}
 		if stmt != nil {
 			statements = append(statements, stmt)
 		}
 	}
-	return statements, nil
+	return statements
+}
+
+// parseBlock parses a brace delimited list of statements, recovering from
+// errors inside it so the rest of the block is still checked.
+func (p *Parser) parseBlock() ([]Statement, lexer.Token, error) {
+	if err := p.match(lexer.LeftBraceToken); err != nil {
+		return nil, lexer.Token{}, err
+	}
+
+	block := []Statement{}
+	// exit names the statement that left the block, if any.
+	var exit string
+	for p.current < len(p.tokens) && p.peek() != lexer.RightBraceToken {
+		if exit != "" {
+			p.warn(p.peekToken(), "unreachable code after "+exit)
+			exit = ""
+		}
+		start := p.current
+		stmt, err := p.parseStatement()
+		if err != nil {
+			p.report(err)
+			p.synchronize(start)
+			continue
+		}
+		switch stmt.(type) {
+		case *ReturnStatement:
+			exit = "return"
+		case *BreakStatement:
+			exit = "break"
+		case *ContinueStatement:
+			exit = "continue"
+		case *ThrowStatement:
+			exit = "throw"
+		}
+		block = append(block, stmt)
+	}
+	rightBrace := p.peekToken()
+	if err := p.match(lexer.RightBraceToken); err != nil {
+		return nil, lexer.Token{}, err
+	}
+	return block, rightBrace, nil
+}
+
+// parseTopLevelStatement parses a statement at the top level of a file,
+// where imports and exports are allowed.
+func (p *Parser) parseTopLevelStatement() (Statement, error) {
+	switch p.peek() {
+	case lexer.ImportToken:
+		return p.parseImportStatement()
+	case lexer.ExportToken:
+		return p.parseExportStatement()
+	default:
+		return p.parseStatement()
+	}
 }
 
 func (p *Parser) parseStatement() (Statement, error) {
 	switch p.peek() {
+	case lexer.ImportToken:
+		return nil, p.error("import is only allowed at the top level of a file")
+	case lexer.ExportToken:
+		return nil, p.error("export is only allowed at the top level of a file")
 	case lexer.LetToken:
 		return p.parseDeclareStatement()
 	case lexer.IfToken:
 		return p.parseIfStatement()
 	case lexer.WhileToken:
-		return p.parseWhileStatement()
-	case lexer.FunctionToken:
-		return p.parseFunctionStatement()
+		return p.parseWhileStatement(nil)
+	case lexer.ForToken:
+		return p.parseForStatement(nil)
+	case lexer.StructToken:
+		return p.parseStructStatement()
+	case lexer.TryToken:
+		return p.parseTryStatement()
+	case lexer.ThrowToken:
+		return p.parseThrowStatement()
 	case lexer.ReturnToken:
 		return p.parseReturnStatement()
+	case lexer.BreakToken, lexer.ContinueToken:
+		return p.parseBranchStatement()
 	case lexer.IdentToken:
-		p.match(lexer.IdentToken)
-		if p.peek() == lexer.AssignToken {
-			p.unmatch()
-			return p.parseAssignStatement()
-		} else if p.peek() == lexer.LeftParenToken {
+		if p.current+1 < len(p.tokens) && p.tokens[p.current+1].Type == lexer.ColonToken {
+			return p.parseLabeledStatement()
+		}
+		return p.parseSimpleStatement()
+	case lexer.FunctionToken:
+		p.match(lexer.FunctionToken)
+		if p.peek() == lexer.IdentToken {
 			p.unmatch()
-			expr, err := p.parseFunctionCall()
-			if err != nil {
-				return nil, err
-			}
-			return ExpressionStatement{expr}, nil
+			return p.parseFunctionStatement()
 		}
 		p.unmatch()
 		fallthrough
 	default:
-		expr, err := p.parseLogicalExpression()
-		if err != nil {
-			return nil, err
+		return p.parseSimpleStatement()
+	}
+}
+
+// parseSimpleStatement parses an expression statement or an assignment.
+func (p *Parser) parseSimpleStatement() (Statement, error) {
+	expr, err := p.parseLogicalExpression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == lexer.AssignToken {
+		return p.parseAssignStatement(expr)
+	}
+
+	return ExpressionStatement{expr}, nil
+}
+
+// parseLabeledStatement parses a loop preceded by a label that break and
+// continue statements inside it can name.
+func (p *Parser) parseLabeledStatement() (Statement, error) {
+	label := p.peekToken()
+	p.match(lexer.IdentToken)
+	p.match(lexer.ColonToken)
+	for _, outer := range p.loops {
+		if outer == label.Literal {
+			return nil, &ParserError{Msg: fmt.Sprintf("duplicate label: %s", label.Literal), Token: label}
 		}
+	}
+
+	switch p.peek() {
+	case lexer.WhileToken:
+		return p.parseWhileStatement(&label)
+	case lexer.ForToken:
+		return p.parseForStatement(&label)
+	default:
+		return nil, p.error(fmt.Sprintf("expected a loop after label %s, found %s", label.Literal, p.found()))
+	}
+}
+
+// loop parses a loop body, during which break and continue refer to the
+// loop labeled label.
+func (p *Parser) loop(label *lexer.Token) ([]Statement, lexer.Token, error) {
+	name := ""
+	if label != nil {
+		name = label.Literal
+	}
+	p.loops = append(p.loops, name)
+	defer func() { p.loops = p.loops[:len(p.loops)-1] }()
+	return p.parseBlock()
+}
+
+func (p *Parser) parseBranchStatement() (Statement, error) {
+	keyword := p.peekToken()
+	p.current++
+	name := "break"
+	if keyword.Type == lexer.ContinueToken {
+		name = "continue"
+	}
+	// A label must be on the same line, so that a bare break can be
+	// followed by an expression statement.
+	var label *lexer.Token
+	if next := p.peekToken(); next.Type == lexer.IdentToken && p.sameLine(next, keyword) {
+		label = &next
+		p.current++
+	}
+
+	if len(p.loops) == 0 {
+		p.report(&ParserError{Msg: name + " outside loop", Token: keyword})
+	} else if label != nil && !slices.Contains(p.loops, label.Literal) {
+		p.report(&ParserError{Msg: fmt.Sprintf("undefined label: %s", label.Literal), Token: *label})
+	}
 
-		return ExpressionStatement{expr}, nil
+	if keyword.Type == lexer.BreakToken {
+		return &BreakStatement{BreakToken: keyword, Label: label}, nil
 	}
+	return &ContinueStatement{ContinueToken: keyword, Label: label}, nil
 }
 
 func (p *Parser) parseDeclareStatement() (Statement, error) {
@@ -160,57 +413,53 @@ func (p *Parser) parseDeclareStatement() (Statement, error) {
 		return nil, err
 	}
 	return &DeclarationStatement{
-		Identifier: &Identifier{identToken},
+		Identifier: &Identifier{Token: identToken},
 		Value:      exp,
 		LetToken:   letToken,
 	}, nil
 }
 
-func (p *Parser) parseAssignStatement() (Statement, error) {
-	ident := p.peekToken()
-	if err := p.match(lexer.IdentToken); err != nil {
+func (p *Parser) parseAssignStatement(target Expression) (Statement, error) {
+	assignToken := p.peekToken()
+	if err := p.match(lexer.AssignToken); err != nil {
 		return nil, err
 	}
-	if p.peek() == lexer.LeftBracketToken {
-		if err := p.match(lexer.LeftBracketToken); err != nil {
-			return nil, err
-		}
-		index, err := p.parseExpression()
+
+	switch target := target.(type) {
+	case *Identifier:
+		exp, err := p.parseLogicalExpression()
 		if err != nil {
 			return nil, err
 		}
-		if err := p.match(lexer.RightBracketToken); err != nil {
-			return nil, err
-		}
-		assignToken := p.peekToken()
-		if err := p.match(lexer.AssignToken); err != nil {
+		return &AssignmentStatement{
+			Identifier:  target,
+			Value:       exp,
+			AssignToken: assignToken,
+		}, nil
+	case *PostfixExpression:
+		exp, err := p.parseLogicalExpression()
+		if err != nil {
 			return nil, err
 		}
+		return &IndexAssignmentStatement{
+			Left:        target.Left,
+			Index:       target.Index,
+			Value:       exp,
+			AssignToken: assignToken,
+		}, nil
+	case *FieldExpression:
 		exp, err := p.parseLogicalExpression()
 		if err != nil {
 			return nil, err
 		}
-		return &IndexAssignmentStatement{
-			Left:        &Identifier{ident},
-			Index:       index,
+		return &FieldAssignmentStatement{
+			Target:      target,
 			Value:       exp,
 			AssignToken: assignToken,
 		}, nil
+	default:
+		return nil, &ParserError{Msg: "invalid assignment target", Token: assignToken}
 	}
-
-	assignToken := p.peekToken()
-	if err := p.match(lexer.AssignToken); err != nil {
-		return nil, err
-	}
-	exp, err := p.parseLogicalExpression()
-	if err != nil {
-		return nil, err
-	}
-	return &AssignmentStatement{
-		Identifier:  &Identifier{ident},
-		Value:       exp,
-		AssignToken: assignToken,
-	}, nil
 }
 
 func (p *Parser) parseIfStatement() (Statement, error) {
@@ -222,28 +471,17 @@ func (p *Parser) parseIfStatement() (Statement, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := p.match(lexer.LeftBraceToken); err != nil {
-		return nil, err
-	}
-
-	thenBlock := []Statement{}
-
-	for p.peek() != lexer.RightBraceToken {
-		stmt, err := p.parseStatement()
-		if err != nil {
-			return nil, err
-		}
-		thenBlock = append(thenBlock, stmt)
-	}
-	if err := p.match(lexer.RightBraceToken); err != nil {
+	thenBlock, rightBrace, err := p.parseBlock()
+	if err != nil {
 		return nil, err
 	}
 
 	if p.peek() != lexer.ElseToken {
 		return &IfStatement{
-			Condition: cond,
-			Then:      thenBlock,
-			IfToken:   ifToken,
+			Condition:  cond,
+			Then:       thenBlock,
+			IfToken:    ifToken,
+			RightBrace: rightBrace,
 		}, nil
 	}
 
@@ -257,31 +495,24 @@ func (p *Parser) parseIfStatement() (Statement, error) {
 			return nil, err
 		}
 		elseBlock = append(elseBlock, elseIf)
+		rightBrace = elseIf.(*IfStatement).RightBrace
 	} else {
-		if err := p.match(lexer.LeftBraceToken); err != nil {
-			return nil, err
-		}
-		for p.peek() != lexer.RightBraceToken {
-			stmt, err := p.parseStatement()
-			if err != nil {
-				return nil, err
-			}
-			elseBlock = append(elseBlock, stmt)
-		}
-		if err := p.match(lexer.RightBraceToken); err != nil {
+		elseBlock, rightBrace, err = p.parseBlock()
+		if err != nil {
 			return nil, err
 		}
 	}
 
 	return &IfStatement{
-		Condition: cond,
-		Then:      thenBlock,
-		Else:      elseBlock,
-		IfToken:   ifToken,
+		Condition:  cond,
+		Then:       thenBlock,
+		Else:       elseBlock,
+		IfToken:    ifToken,
+		RightBrace: rightBrace,
 	}, nil
 }
 
-func (p *Parser) parseWhileStatement() (Statement, error) {
+func (p *Parser) parseWhileStatement(label *lexer.Token) (Statement, error) {
 	whileToken := p.peekToken()
 	if err := p.match(lexer.WhileToken); err != nil {
 		return nil, err
@@ -291,24 +522,69 @@ func (p *Parser) parseWhileStatement() (Statement, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := p.match(lexer.LeftBraceToken); err != nil {
+	body, rightBrace, err := p.loop(label)
+	if err != nil {
 		return nil, err
 	}
-	body := []Statement{}
-	for p.peek() != lexer.RightBraceToken {
-		stmt, err := p.parseStatement()
-		if err != nil {
+	return &WhileStatement{
+		Condition:  cond,
+		Body:       body,
+		Label:      label,
+		WhileToken: whileToken,
+		RightBrace: rightBrace,
+	}, nil
+}
+
+func (p *Parser) parseForStatement(label *lexer.Token) (Statement, error) {
+	forToken := p.peekToken()
+	if err := p.match(lexer.ForToken); err != nil {
+		return nil, err
+	}
+
+	var index *Identifier
+	value := p.peekToken()
+	if err := p.match(lexer.IdentToken); err != nil {
+		return nil, err
+	}
+	if p.peek() == lexer.CommaToken {
+		p.match(lexer.CommaToken)
+		index = &Identifier{Token: value}
+		value = p.peekToken()
+		if err := p.match(lexer.IdentToken); err != nil {
 			return nil, err
 		}
-		body = append(body, stmt)
+		if value.Literal == index.String() {
+			return nil, &ParserError{Msg: fmt.Sprintf("duplicate loop variable: %s", value.Literal), Token: value}
+		}
 	}
-	if err := p.match(lexer.RightBraceToken); err != nil {
+	if err := p.match(lexer.InToken); err != nil {
 		return nil, err
 	}
-	return &WhileStatement{
-		Condition:  cond,
+
+	iterable, err := p.parseLogicalExpression()
+	if err != nil {
+		return nil, err
+	}
+	var end Expression
+	if p.peek() == lexer.DotDotToken {
+		p.match(lexer.DotDotToken)
+		if end, err = p.parseLogicalExpression(); err != nil {
+			return nil, err
+		}
+	}
+	body, rightBrace, err := p.loop(label)
+	if err != nil {
+		return nil, err
+	}
+	return &ForStatement{
+		Index:      index,
+		Value:      &Identifier{Token: value},
+		Iterable:   iterable,
+		End:        end,
 		Body:       body,
-		WhileToken: whileToken,
+		Label:      label,
+		ForToken:   forToken,
+		RightBrace: rightBrace,
 	}, nil
 }
 
@@ -377,24 +653,6 @@ func (p *Parser) parseLogicalUnary() (Expression, error) {
 			Right:   right,
 			OpToken: opToken,
 		}, nil
-	} else {
-		return p.parseLogicalFactor()
-	}
-}
-
-func (p *Parser) parseLogicalFactor() (Expression, error) {
-	if p.peek() == lexer.LeftParenToken {
-		if err := p.match(lexer.LeftParenToken); err != nil {
-			return nil, err
-		}
-		expr, err := p.parseLogicalExpression()
-		if err != nil {
-			return nil, err
-		}
-		if err := p.match(lexer.RightParenToken); err != nil {
-			return nil, err
-		}
-		return expr, nil
 	} else {
 		return p.parseComparison()
 	}
@@ -499,30 +757,52 @@ func (p *Parser) parseUnary() (Expression, error) {
 }
 
 func (p *Parser) parseFactor() (Expression, error) {
-	primary, err := p.parsePrimary()
+	expr, err := p.parsePrimary()
 	if err != nil {
 		return nil, err
 	}
 
-	if p.peek() == lexer.LeftBracketToken {
-		bracketToken := p.peekToken()
-		if err := p.match(lexer.LeftBracketToken); err != nil {
-			return nil, err
-		}
-		index, err := p.parseExpression()
-		if err != nil {
-			return nil, err
-		}
-		if err := p.match(lexer.RightBracketToken); err != nil {
-			return nil, err
+	// A bracket, paren or dot at the start of a line begins the next
+	// statement rather than continuing this one.
+	for p.current >= len(p.tokens) || !p.startsLine() {
+		switch p.peek() {
+		case lexer.LeftBracketToken:
+			bracketToken := p.peekToken()
+			if err := p.match(lexer.LeftBracketToken); err != nil {
+				return nil, err
+			}
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			rightBracket := p.peekToken()
+			if err := p.match(lexer.RightBracketToken); err != nil {
+				return nil, err
+			}
+			expr = &PostfixExpression{
+				Left:         expr,
+				Index:        index,
+				BracketToken: bracketToken,
+				RightBracket: rightBracket,
+			}
+		case lexer.LeftParenToken:
+			expr, err = p.parseFunctionCall(expr)
+			if err != nil {
+				return nil, err
+			}
+		case lexer.DotToken:
+			dotToken := p.peekToken()
+			p.match(lexer.DotToken)
+			field := p.peekToken()
+			if err := p.match(lexer.IdentToken); err != nil {
+				return nil, err
+			}
+			expr = &FieldExpression{Left: expr, Field: field, DotToken: dotToken}
+		default:
+			return expr, nil
 		}
-		return &PostfixExpression{
-			Left:         primary,
-			Index:        index,
-			BracketToken: bracketToken,
-		}, nil
 	}
-	return primary, nil
+	return expr, nil
 }
 
 func (p *Parser) parsePrimary() (Expression, error) {
@@ -531,7 +811,7 @@ func (p *Parser) parsePrimary() (Expression, error) {
 		if err := p.match(lexer.LeftParenToken); err != nil {
 			return nil, err
 		}
-		expr, err := p.parseExpression()
+		expr, err := p.parseLogicalExpression()
 		if err != nil {
 			return nil, err
 		}
@@ -544,9 +824,9 @@ func (p *Parser) parsePrimary() (Expression, error) {
 		if err := p.match(lexer.NumberToken); err != nil {
 			return nil, err
 		}
-		value, err := strconv.ParseFloat(token.Literal, 64)
+		value, err := parseNumber(token.Literal)
 		if err != nil {
-			return nil, err
+			return nil, &ParserError{Msg: fmt.Sprintf("invalid number literal %s", token.Literal), Token: token}
 		}
 		return &NumberLiteral{Value: value, Token: token}, nil
 	case lexer.StringToken:
@@ -554,6 +834,9 @@ func (p *Parser) parsePrimary() (Expression, error) {
 		if err := p.match(lexer.StringToken); err != nil {
 			return nil, err
 		}
+		if token.Parts != nil {
+			return p.parseInterpolatedString(token)
+		}
 		return &StringLiteral{Value: token.Literal, Token: token}, nil
 	case lexer.TrueToken, lexer.FalseToken:
 		token := p.peekToken()
@@ -567,20 +850,55 @@ func (p *Parser) parsePrimary() (Expression, error) {
 	case lexer.IdentToken:
 		token := p.peekToken()
 		p.match(lexer.IdentToken)
-		if p.peek() == lexer.LeftParenToken {
-			p.unmatch()
-			return p.parseFunctionCall()
-		}
-		return &Identifier{token}, nil
+		return &Identifier{Token: token}, nil
 	case lexer.LeftBracketToken:
 		return p.parseArrayLiteral()
+	case lexer.LeftBraceToken:
+		return p.parseMapLiteral()
+	case lexer.FunctionToken:
+		return p.parseFunctionLiteral()
 	case lexer.VoidToken:
 		t := p.peekToken()
 		p.match(lexer.VoidToken)
 		return VoidLiteral(t), nil
 	default:
-		return nil, p.error(fmt.Sprintf("unexpected token in primary expression: %s", p.peek()))
+		return nil, p.error(fmt.Sprintf("unexpected token in primary expression: %s", p.found()))
+	}
+}
+
+// parseNumber converts a number literal as produced by the lexer. Prefixed
+// literals are integers; everything else goes through ParseFloat, which
+// already understands exponents and digit separators.
+func parseNumber(literal string) (float64, error) {
+	if len(literal) > 1 && literal[0] == '0' {
+		switch literal[1] {
+		case 'x', 'X', 'b', 'B', 'o', 'O':
+			n, err := strconv.ParseUint(literal, 0, 64)
+			return float64(n), err
+		}
+	}
+	return strconv.ParseFloat(literal, 64)
+}
+
+func (p *Parser) parseInterpolatedString(token lexer.Token) (Expression, error) {
+	var parts []Expression
+	for _, part := range token.Parts {
+		if part.Tokens == nil {
+			parts = append(parts, &StringLiteral{Value: part.Text, Token: token})
+			continue
+		}
+		sub := New(p.file, part.Tokens)
+		sub.end = "end of interpolation"
+		expr, err := sub.parseLogicalExpression()
+		if err != nil {
+			return nil, err
+		}
+		if sub.current < len(sub.tokens) {
+			return nil, sub.error(fmt.Sprintf("unexpected token in string interpolation: %s", sub.peek()))
+		}
+		parts = append(parts, expr)
 	}
+	return &InterpolatedString{Parts: parts, Token: token}, nil
 }
 
 func (p *Parser) parseArrayLiteral() (Expression, error) {
@@ -601,10 +919,95 @@ func (p *Parser) parseArrayLiteral() (Expression, error) {
 			}
 		}
 	}
+	rightBracket := p.peekToken()
 	if err := p.match(lexer.RightBracketToken); err != nil {
 		return nil, err
 	}
-	return &ArrayLiteral{Elements: elements, Token: bracketToken}, nil
+	return &ArrayLiteral{Elements: elements, Token: bracketToken, RightBracket: rightBracket}, nil
+}
+
+func (p *Parser) parseMapLiteral() (Expression, error) {
+	braceToken := p.peekToken()
+	if err := p.match(lexer.LeftBraceToken); err != nil {
+		return nil, err
+	}
+	lit := &MapLiteral{Token: braceToken}
+	for p.peek() != lexer.RightBraceToken {
+		key, err := p.parseLogicalExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.match(lexer.ColonToken); err != nil {
+			return nil, err
+		}
+		value, err := p.parseLogicalExpression()
+		if err != nil {
+			return nil, err
+		}
+		lit.Keys = append(lit.Keys, key)
+		lit.Values = append(lit.Values, value)
+		if p.peek() != lexer.CommaToken {
+			break
+		}
+		p.match(lexer.CommaToken)
+	}
+	lit.RightBrace = p.peekToken()
+	if err := p.match(lexer.RightBraceToken); err != nil {
+		return nil, err
+	}
+	return lit, nil
+}
+
+// parseStructStatement parses a struct declaration: its name and, in
+// braces, a comma separated list of field names followed by its methods.
+func (p *Parser) parseStructStatement() (Statement, error) {
+	stmt := &StructStatement{StructToken: p.peekToken()}
+	p.match(lexer.StructToken)
+	name := p.peekToken()
+	if err := p.match(lexer.IdentToken); err != nil {
+		return nil, err
+	}
+	stmt.Name = &Identifier{Token: name}
+	if err := p.match(lexer.LeftBraceToken); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for p.peek() == lexer.IdentToken {
+		field := p.peekToken()
+		if err := p.match(lexer.IdentToken); err != nil {
+			return nil, err
+		}
+		if seen[field.Literal] {
+			p.report(&ParserError{Msg: fmt.Sprintf("duplicate field: %s", field.Literal), Token: field})
+		}
+		seen[field.Literal] = true
+		stmt.Fields = append(stmt.Fields, field)
+		if p.peek() != lexer.CommaToken {
+			break
+		}
+		p.match(lexer.CommaToken)
+	}
+	for p.peek() == lexer.FunctionToken {
+		method, err := p.parseFunctionStatement()
+		if err != nil {
+			return nil, err
+		}
+		m := method.(*FunctionStatement)
+		if seen[m.Name.String()] {
+			p.report(&ParserError{Msg: fmt.Sprintf("duplicate method: %s", m.Name), Token: m.Name.Token})
+		}
+		seen[m.Name.String()] = true
+		// The receiver is passed as an implicit first argument.
+		self := m.Name.Token
+		self.Literal = "self"
+		m.Args = append([]*Identifier{{Token: self}}, m.Args...)
+		stmt.Methods = append(stmt.Methods, m)
+	}
+	stmt.RightBrace = p.peekToken()
+	if err := p.match(lexer.RightBraceToken); err != nil {
+		return nil, err
+	}
+	return stmt, nil
 }
 
 func (p *Parser) parseFunctionStatement() (Statement, error) {
@@ -617,30 +1020,50 @@ func (p *Parser) parseFunctionStatement() (Statement, error) {
 	if err := p.match(lexer.IdentToken); err != nil {
 		return nil, err
 	}
-	funcStmt.Name = &Identifier{ident}
+	funcStmt.Name = &Identifier{Token: ident}
 	funcStmt.FuncToken = funcToken
-	if p.peek() == lexer.ColonToken {
-		args, err := p.parseArgumentStatement()
-		if err != nil {
-			return nil, err
-		}
-		funcStmt.Args = args
+	args, body, rightBrace, err := p.parseFunctionBody()
+	if err != nil {
+		return nil, err
 	}
+	funcStmt.Args = args
+	funcStmt.Body = body
+	funcStmt.RightBrace = rightBrace
+	return &funcStmt, nil
+}
 
-	if err := p.match(lexer.LeftBraceToken); err != nil {
+func (p *Parser) parseFunctionLiteral() (Expression, error) {
+	funcToken := p.peekToken()
+	if err := p.match(lexer.FunctionToken); err != nil {
 		return nil, err
 	}
+	args, body, rightBrace, err := p.parseFunctionBody()
+	if err != nil {
+		return nil, err
+	}
+	return &FunctionLiteral{Args: args, Body: body, FuncToken: funcToken, RightBrace: rightBrace}, nil
+}
 
-	for p.peek() != lexer.RightBraceToken {
-		stmt, err := p.parseStatement()
+func (p *Parser) parseFunctionBody() ([]*Identifier, []Statement, lexer.Token, error) {
+	// Loops outside the function cannot be broken out of from inside it.
+	loops := p.loops
+	p.loops = nil
+	defer func() { p.loops = loops }()
+
+	var args []*Identifier
+	if p.peek() == lexer.ColonToken {
+		decls, err := p.parseArgumentStatement()
 		if err != nil {
-			return nil, err
+			return nil, nil, lexer.Token{}, err
 		}
-		funcStmt.Body = append(funcStmt.Body, stmt)
+		args = decls
 	}
 
-	p.match(lexer.RightBraceToken)
-	return funcStmt, nil
+	body, rightBrace, err := p.parseBlock()
+	if err != nil {
+		return nil, nil, lexer.Token{}, err
+	}
+	return args, body, rightBrace, nil
 }
 
 func (p *Parser) parseArgumentStatement() ([]*Identifier, error) {
@@ -650,26 +1073,22 @@ func (p *Parser) parseArgumentStatement() ([]*Identifier, error) {
 	if err := p.match(lexer.IdentToken); err != nil {
 		return nil, err
 	}
-	decls = append(decls, &Identifier{ident})
+	decls = append(decls, &Identifier{Token: ident})
 	for p.peek() == lexer.CommaToken {
 		p.match(lexer.CommaToken)
 		ident := p.peekToken()
 		if err := p.match(lexer.IdentToken); err != nil {
 			return nil, err
 		}
-		decls = append(decls, &Identifier{ident})
+		decls = append(decls, &Identifier{Token: ident})
 	}
 
 	return decls, nil
 }
 
-func (p *Parser) parseFunctionCall() (Expression, error) {
-	ident := p.peekToken()
-	if err := p.match(lexer.IdentToken); err != nil {
-		return nil, err
-	}
+func (p *Parser) parseFunctionCall(callee Expression) (Expression, error) {
 	var fnCall FunctionCallExpression
-	fnCall.Name = &Identifier{ident}
+	fnCall.Callee = callee
 	leftParen := p.peekToken()
 	if err := p.match(lexer.LeftParenToken); err != nil {
 		return nil, err
@@ -677,14 +1096,14 @@ func (p *Parser) parseFunctionCall() (Expression, error) {
 	fnCall.LeftParen = leftParen
 
 	if p.peek() != lexer.RightParenToken {
-		arg, err := p.parseExpression()
+		arg, err := p.parseLogicalExpression()
 		if err != nil {
 			return nil, err
 		}
 		fnCall.Args = append(fnCall.Args, arg)
 		for p.peek() == lexer.CommaToken {
 			p.match(lexer.CommaToken)
-			expr, err := p.parseExpression()
+			expr, err := p.parseLogicalExpression()
 			if err != nil {
 				return nil, err
 			}
@@ -692,12 +1111,59 @@ func (p *Parser) parseFunctionCall() (Expression, error) {
 		}
 	}
 
+	fnCall.RightParen = p.peekToken()
 	if err := p.match(lexer.RightParenToken); err != nil {
 		return nil, p.error("expected right closing paren.")
 	}
 	return fnCall, nil
 }
 
+// parseTryStatement parses a try block followed by a catch clause, a
+// finally clause or both.
+func (p *Parser) parseTryStatement() (Statement, error) {
+	stmt := &TryStatement{TryToken: p.peekToken()}
+	p.match(lexer.TryToken)
+	body, rightBrace, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Body, stmt.RightBrace = body, rightBrace
+	if p.peek() == lexer.CatchToken {
+		p.match(lexer.CatchToken)
+		if p.peek() == lexer.IdentToken {
+			stmt.CatchVar = &Identifier{Token: p.peekToken()}
+			p.match(lexer.IdentToken)
+		}
+		catch, rightBrace, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Catch, stmt.RightBrace = catch, rightBrace
+	}
+	if p.peek() == lexer.FinallyToken {
+		p.match(lexer.FinallyToken)
+		finally, rightBrace, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Finally, stmt.RightBrace = finally, rightBrace
+	}
+	if stmt.Catch == nil && stmt.Finally == nil {
+		return nil, p.error(fmt.Sprintf("expected catch or finally after try block, found %s", p.found()))
+	}
+	return stmt, nil
+}
+
+func (p *Parser) parseThrowStatement() (Statement, error) {
+	throwToken := p.peekToken()
+	p.match(lexer.ThrowToken)
+	expr, err := p.parseLogicalExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &ThrowStatement{Value: expr, ThrowToken: throwToken}, nil
+}
+
 func (p *Parser) parseReturnStatement() (Statement, error) {
 	returnToken := p.peekToken()
 	p.match(lexer.ReturnToken)
@@ -711,3 +1177,105 @@ func (p *Parser) parseReturnStatement() (Statement, error) {
 	}
 	return &ReturnStatement{Return: expr, ReturnToken: returnToken}, nil
 }
+
+// peekWord reports whether the next token is the identifier word, which
+// acts as a keyword in some positions but can still name variables.
+func (p *Parser) peekWord(word string) bool {
+	return p.peek() == lexer.IdentToken && p.peekToken().Literal == word
+}
+
+func (p *Parser) parseImportStatement() (Statement, error) {
+	stmt := &ImportStatement{ImportToken: p.peekToken()}
+	p.match(lexer.ImportToken)
+	if p.peek() == lexer.LeftBraceToken {
+		p.match(lexer.LeftBraceToken)
+		if p.peek() != lexer.IdentToken {
+			return nil, p.error(fmt.Sprintf("expected a name to import, found %s", p.found()))
+		}
+		for p.peek() == lexer.IdentToken {
+			export := p.peekToken()
+			p.match(lexer.IdentToken)
+			name := ImportedName{Export: &Identifier{Token: export}}
+			name.Alias = name.Export
+			if p.peekWord("as") {
+				p.current++
+				alias := p.peekToken()
+				if err := p.match(lexer.IdentToken); err != nil {
+					return nil, err
+				}
+				name.Alias = &Identifier{Token: alias}
+			}
+			stmt.Names = append(stmt.Names, name)
+			if p.peek() != lexer.CommaToken {
+				break
+			}
+			p.match(lexer.CommaToken)
+		}
+		if err := p.match(lexer.RightBraceToken); err != nil {
+			return nil, err
+		}
+		if !p.peekWord("from") {
+			return nil, p.error(fmt.Sprintf("expected from, found %s", p.found()))
+		}
+		p.current++
+	}
+
+	path := p.peekToken()
+	if err := p.match(lexer.StringToken); err != nil {
+		return nil, err
+	}
+	if path.Parts != nil {
+		return nil, &ParserError{Msg: "import path cannot be interpolated", Token: path}
+	}
+	stmt.Path = &StringLiteral{Value: path.Literal, Token: path}
+	if stmt.Names != nil {
+		return stmt, nil
+	}
+
+	// Like a label, the name a module is imported as must be on the same
+	// line as the path.
+	if p.peekWord("as") && p.sameLine(p.peekToken(), path) {
+		p.current++
+		name := p.peekToken()
+		if err := p.match(lexer.IdentToken); err != nil {
+			return nil, err
+		}
+		stmt.Name = &Identifier{Token: name}
+		return stmt, nil
+	}
+	// Otherwise the module is named after its file.
+	name := path
+	name.Literal = strings.TrimSuffix(filepath.Base(path.Literal), filepath.Ext(path.Literal))
+	if !isIdentifier(name.Literal) {
+		return nil, &ParserError{Msg: fmt.Sprintf("cannot name module %q after its file, use import %q as name", name.Literal, path.Literal), Token: path}
+	}
+	stmt.Name = &Identifier{Token: name}
+	return stmt, nil
+}
+
+// isIdentifier reports whether name lexes as a single identifier.
+func isIdentifier(name string) bool {
+	tokens, err := lexer.New(lexer.NewFileSet().AddFile("", name)).Tokenize()
+	return err == nil && len(tokens) == 1 && tokens[0].Type == lexer.IdentToken && tokens[0].Literal == name
+}
+
+func (p *Parser) parseExportStatement() (Statement, error) {
+	exportToken := p.peekToken()
+	p.match(lexer.ExportToken)
+	var decl Statement
+	var err error
+	switch p.peek() {
+	case lexer.LetToken:
+		decl, err = p.parseDeclareStatement()
+	case lexer.FunctionToken:
+		decl, err = p.parseFunctionStatement()
+	case lexer.StructToken:
+		decl, err = p.parseStructStatement()
+	default:
+		return nil, p.error(fmt.Sprintf("expected a declaration after export, found %s", p.found()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ExportStatement{Decl: decl, ExportToken: exportToken}, nil
+}
@@ -0,0 +1,194 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/printchard/tiny-lang/lexer"
+)
+
+// run runs src on the tree-walking interpreter in a new default
+// environment and returns what it printed.
+func run(t *testing.T, src string) (string, error) {
+	t.Helper()
+	env := NewDefaultEnvironment()
+	var out strings.Builder
+	env.SetIO(IO{Stdout: &out})
+	file := env.FileSet().AddFile("test.tiny", src)
+	tokens, err := lexer.New(file).Tokenize()
+	if err != nil {
+		return "", err
+	}
+	err = New(file, tokens).Execute(env)
+	return out.String(), err
+}
+
+// parse lexes and parses the source of file, which must be free of errors.
+func parse(t *testing.T, file *lexer.File) []Statement {
+	t.Helper()
+	tokens, err := lexer.New(file).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts, err := New(file, tokens).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stmts
+}
+
+func expectOutput(t *testing.T, src, want string) {
+	t.Helper()
+	got, err := run(t, src)
+	if err != nil {
+		t.Fatalf("running %q: %v", src, err)
+	}
+	if got != want {
+		t.Errorf("running %q printed %q, want %q", src, got, want)
+	}
+}
+
+func expectError(t *testing.T, src, want string) {
+	t.Helper()
+	_, err := run(t, src)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("running %q: got error %v, want %q", src, err, want)
+	}
+}
+
+func TestCallArbitraryExpressions(t *testing.T) {
+	expectOutput(t, `print(func: x { return x * 2 }(3))`, "6.000000\n")
+	expectOutput(t, `let fs := [func { return "a" }, func { return "b" }]
+print(fs[1]())`, "b\n")
+	expectOutput(t, `func adder: n { return func: x { return x + n } }
+print(adder(1)(2))`, "3.000000\n")
+	expectOutput(t, `(print)("parenthesized")`, "parenthesized\n")
+}
+
+func TestCallNonFunction(t *testing.T) {
+	expectError(t, `let a := 5
+a(1)`, "function call to non-function type: Number")
+	expectError(t, `[1, 2][0]()`, "function call to non-function type: Number")
+	expectError(t, `"s"()`, "function call to non-function type: String")
+}
+
+func TestPostfixStopsAtNewline(t *testing.T) {
+	expectOutput(t, `let x := [1, 2]
+print(x)
+[3, 4]
+(print)("paren")`, "[1.000000 2.000000]\nparen\n")
+	expectOutput(t, `let f := func { return [1, 2] }
+print(f()[1])`, "2.000000\n")
+}
+
+func TestClosures(t *testing.T) {
+	expectOutput(t, `func counter { let n := 0
+  return func { n = n + 1
+    return n } }
+let a := counter()
+let b := counter()
+a()
+print(a(), b())`, "2.000000 1.000000\n")
+	expectOutput(t, `func pair { let v := 1
+  return [func { v = v * 10 }, func { return v }] }
+let p := pair()
+p[0]()
+print(p[1]())`, "10.000000\n")
+	expectOutput(t, `let fs := {}
+let i := 0
+while i < 3 { let j := i
+  fs[i] = func { return j }
+  i = i + 1 }
+print(fs[0](), fs[2]())`, "0.000000 2.000000\n")
+}
+
+func TestFunctionLiterals(t *testing.T) {
+	expectOutput(t, `let sq := func: x { return x * x }
+print(sq(4))`, "16.000000\n")
+	expectOutput(t, `func apply: f, x { return f(x) }
+print(apply(func: n { return n + 1 }, 1))`, "2.000000\n")
+	expectOutput(t, `let m := {"inc": func: n { return n + 1 }}
+print(m["inc"](2))`, "3.000000\n")
+	expectOutput(t, `let f := func { }
+print(f())`, "void\n")
+}
+
+func TestNumberLiterals(t *testing.T) {
+	expectOutput(t, `print(0x1F, 0b101, 0o17, 1_000, 1.5e3, 2E-2)`, "31.000000 5.000000 15.000000 1000.000000 1500.000000 0.020000\n")
+}
+
+// diagnose lexes and parses src and returns the line and message of each
+// problem found.
+func diagnose(src string) []string {
+	fset := lexer.NewFileSet()
+	file := fset.AddFile("test.tiny", src)
+	tokens, err := lexer.New(file).Tokenize()
+	var diags lexer.Diagnostics
+	if err != nil {
+		diags = err.(lexer.Diagnostics)
+	}
+	p := New(file, tokens)
+	p.Parse()
+	var got []string
+	for _, diag := range append(diags, p.Diagnostics()...) {
+		got = append(got, fmt.Sprintf("%d: %s", fset.Position(diag.Pos()).Line, diag.Message()))
+	}
+	return got
+}
+
+func TestErrorRecovery(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []string
+	}{
+		{`let x := )
+print("ok")
+let y := 1 +
+let z := 3`, []string{
+			"1: unexpected token in primary expression: )",
+			"4: unexpected token in primary expression: LET",
+		}},
+		{`let a := 1 $ 2
+let b := 2 @ 3`, []string{
+			"1: unexpected character '$'",
+			"2: unexpected character '@'",
+		}},
+		{`func f { return 1
+  print("dead") }`, []string{
+			"2: unreachable code after return",
+		}},
+	} {
+		if got := diagnose(tc.src); !slices.Equal(got, tc.want) {
+			t.Errorf("diagnostics of %q:\ngot  %q\nwant %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestNodeSpans(t *testing.T) {
+	src := "let total := f(1, [2, 3]) + \"é\"\n"
+	file := lexer.NewFileSet().AddFile("test.tiny", src)
+	stmts := parse(t, file)
+	text := func(n Node) string {
+		span := n.Span()
+		return src[file.Offset(span.Start):file.Offset(span.End)]
+	}
+
+	decl := stmts[0].(*DeclarationStatement)
+	sum := decl.Value.(*BinaryExpression)
+	for _, tc := range []struct {
+		node Node
+		want string
+	}{
+		{decl, `let total := f(1, [2, 3]) + "é"`},
+		{decl.Identifier, "total"},
+		{sum, `f(1, [2, 3]) + "é"`},
+		{sum.Left, "f(1, [2, 3])"},
+		{sum.Right, `"é"`},
+	} {
+		if got := text(tc.node); got != tc.want {
+			t.Errorf("span of %s covers %q, want %q", tc.node, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package parser
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/printchard/tiny-lang/lexer"
+)
+
+// ResolveError is a name that is used without being declared, or declared
+// twice, found before the program runs.
+type ResolveError struct {
+	Msg string
+	lexer.Token
+	Span lexer.Span
+}
+
+func (e *ResolveError) Error() string {
+	return e.Msg
+}
+
+func (e *ResolveError) Format(fset *lexer.FileSet) string {
+	pos := fset.Position(e.Start)
+	msg := fmt.Sprintf("[%s:%d:%d]: %s", pos.Filename, pos.Line, pos.Column, e.Msg)
+	if excerpt := fset.File(e.Start).Underline(e.Span, e.Start); excerpt != "" {
+		msg += "\n" + excerpt
+	}
+	return msg
+}
+
+func (e *ResolveError) Severity() lexer.Severity {
+	return lexer.SeverityError
+}
+
+func (e *ResolveError) Message() string {
+	return e.Msg
+}
+
+type binding struct {
+	slot     int
+	declared bool
+}
+
+// resolverScope mirrors an environment the program will run in: the
+// globals, a function call or a block.
+type resolverScope struct {
+	names map[string]*binding
+	slots int
+	// function is the nesting level of the function the scope belongs to.
+	function int
+}
+
+type resolver struct {
+	env    *Environment
+	scopes []*resolverScope
+	// function is the nesting level of the function being resolved; the
+	// top level is 0.
+	function    int
+	diagnostics lexer.Diagnostics
+	// dir is the directory imports are relative to.
+	dir    string
+	loader *loader
+}
+
+// Resolve binds every identifier in a program to the variable it refers
+// to, and must run before the program is executed. Top level declarations
+// are globals, checked against env; everything else is a local with a slot
+// in its block or function frame.
+//
+// Within a function, a variable is only visible after its declaration. A
+// nested function sees every variable of the enclosing scopes, since it may
+// be called once they are defined; using one too early is still a runtime
+// error. Like Tokenize, Resolve returns the problems it found as
+// lexer.Diagnostics.
+//
+// Resolve also loads the modules the program imports, with paths relative
+// to the working directory.
+func Resolve(stmts []Statement, env *Environment) error {
+	if diags := ResolveFile(stmts, env, ""); diags.HasErrors() {
+		return diags
+	}
+	return nil
+}
+
+// ResolveFile is like Resolve for the statements of the file at path,
+// whose imports are relative to its directory. It returns every problem
+// found, including those in the modules it loads, which may be warnings;
+// the program can run unless one of them is an error. The files of the
+// modules are added to env's FileSet, where their diagnostics are located.
+func ResolveFile(stmts []Statement, env *Environment, path string) lexer.Diagnostics {
+	r := &resolver{
+		env:    env,
+		dir:    filepath.Dir(path),
+		loader: &loader{program: env.program(), failed: make(map[string]bool)},
+	}
+	return r.resolve(stmts)
+}
+
+func (r *resolver) resolve(stmts []Statement) lexer.Diagnostics {
+	r.push().hoist(stmts)
+	r.resolveStmts(stmts)
+	return r.diagnostics
+}
+
+func (r *resolver) report(n Node, msg string) {
+	r.diagnostics = append(r.diagnostics, &ResolveError{Msg: msg, Token: n.GetToken(), Span: n.Span()})
+}
+
+func (r *resolver) push() *resolverScope {
+	s := &resolverScope{names: make(map[string]*binding), function: r.function}
+	r.scopes = append(r.scopes, s)
+	return s
+}
+
+func (r *resolver) pop() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// hoist reserves a slot for each variable stmts declare directly in s, so
+// nested functions can refer to variables declared after them.
+func (s *resolverScope) hoist(stmts []Statement) {
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *DeclarationStatement:
+			s.add(stmt.Identifier.String())
+		case *FunctionStatement:
+			s.add(stmt.Name.String())
+		case *StructStatement:
+			s.add(stmt.Name.String())
+		case *ExportStatement:
+			s.add(stmt.Name().String())
+		case *ImportStatement:
+			for _, id := range stmt.Bindings() {
+				s.add(id.String())
+			}
+		}
+	}
+}
+
+func (s *resolverScope) add(name string) *binding {
+	if b, ok := s.names[name]; ok {
+		return b
+	}
+	b := &binding{slot: s.slots}
+	s.names[name] = b
+	s.slots++
+	return b
+}
+
+// bind points id at the variable it names, reporting whether one is
+// visible.
+func (r *resolver) bind(id *Identifier) bool {
+	name := id.String()
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		s := r.scopes[i]
+		b, ok := s.names[name]
+		if !ok || !b.declared && s.function == r.function {
+			continue
+		}
+		if i == 0 {
+			id.Local = false
+		} else {
+			id.Local, id.Depth, id.Slot = true, len(r.scopes)-1-i, b.slot
+		}
+		return true
+	}
+	id.Local = false
+	_, ok := r.env.Get(name)
+	return ok
+}
+
+// declared reports whether the variable id names is already declared where
+// id would declare it. Builtins are not, so declarations can shadow them.
+func (r *resolver) declared(id *Identifier) bool {
+	name := id.String()
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		s := r.scopes[i]
+		if b, ok := s.names[name]; ok && (b.declared || s.function != r.function) {
+			return true
+		}
+	}
+	return r.env.Declared(name)
+}
+
+// declare marks the variable id names as declared in the current scope.
+func (r *resolver) declare(id *Identifier) {
+	b := r.scopes[len(r.scopes)-1].add(id.String())
+	b.declared = true
+	if len(r.scopes) == 1 {
+		id.Local = false
+	} else {
+		id.Local, id.Depth, id.Slot = true, 0, b.slot
+	}
+}
+
+func (r *resolver) resolveStmts(stmts []Statement) {
+	for _, stmt := range stmts {
+		r.resolveStmt(stmt)
+	}
+}
+
+func (r *resolver) resolveBlock(stmts []Statement) int {
+	s := r.push()
+	s.hoist(stmts)
+	r.resolveStmts(stmts)
+	r.pop()
+	return s.slots
+}
+
+func (r *resolver) resolveFunction(args []*Identifier, body []Statement) int {
+	r.function++
+	s := r.push()
+	for _, arg := range args {
+		if _, ok := s.names[arg.String()]; ok {
+			r.report(arg, fmt.Sprintf("duplicate argument: %s", arg))
+		}
+		r.declare(arg)
+	}
+	s.hoist(body)
+	r.resolveStmts(body)
+	r.pop()
+	r.function--
+	return s.slots
+}
+
+func (r *resolver) resolveStmt(stmt Statement) {
+	switch s := stmt.(type) {
+	case *DeclarationStatement:
+		if r.declared(s.Identifier) {
+			r.report(s, fmt.Sprintf("variable already declared: %s", s.Identifier))
+		}
+		r.resolveExpr(s.Value)
+		r.declare(s.Identifier)
+	case *AssignmentStatement:
+		if !r.bind(s.Identifier) {
+			r.report(s, fmt.Sprintf("undefined variable: %s", s.Identifier))
+		}
+		r.resolveExpr(s.Value)
+	case *IndexAssignmentStatement:
+		r.resolveExpr(s.Left)
+		r.resolveExpr(s.Index)
+		r.resolveExpr(s.Value)
+	case *FieldAssignmentStatement:
+		r.resolveExpr(s.Target.Left)
+		r.resolveExpr(s.Value)
+	case *IfStatement:
+		r.resolveExpr(s.Condition)
+		s.slots = max(r.resolveBlock(s.Then), r.resolveBlock(s.Else))
+	case *WhileStatement:
+		r.resolveExpr(s.Condition)
+		s.slots = r.resolveBlock(s.Body)
+	case *ForStatement:
+		r.resolveExpr(s.Iterable)
+		if s.End != nil {
+			r.resolveExpr(s.End)
+		}
+		// The loop variables share a frame with the body's locals.
+		scope := r.push()
+		for _, id := range []*Identifier{s.Index, s.Value} {
+			if id == nil {
+				continue
+			}
+			if r.declared(id) {
+				r.report(id, fmt.Sprintf("variable already declared: %s", id))
+			}
+			r.declare(id)
+		}
+		scope.hoist(s.Body)
+		r.resolveStmts(s.Body)
+		r.pop()
+		s.slots = scope.slots
+	case *TryStatement:
+		s.bodySlots = r.resolveBlock(s.Body)
+		if s.Catch != nil {
+			// The caught value shares a frame with the clause's locals.
+			scope := r.push()
+			if s.CatchVar != nil {
+				if r.declared(s.CatchVar) {
+					r.report(s.CatchVar, fmt.Sprintf("variable already declared: %s", s.CatchVar))
+				}
+				r.declare(s.CatchVar)
+			}
+			scope.hoist(s.Catch)
+			r.resolveStmts(s.Catch)
+			r.pop()
+			s.catchSlots = scope.slots
+		}
+		s.finallySlots = r.resolveBlock(s.Finally)
+	case *ThrowStatement:
+		r.resolveExpr(s.Value)
+	case ExpressionStatement:
+		r.resolveExpr(s.Expr)
+	case *FunctionStatement:
+		r.declare(s.Name)
+		s.slots = r.resolveFunction(s.Args, s.Body)
+	case *StructStatement:
+		r.declare(s.Name)
+		for _, method := range s.Methods {
+			method.slots = r.resolveFunction(method.Args, method.Body)
+		}
+	case *ReturnStatement:
+		if s.Return != nil {
+			r.resolveExpr(s.Return)
+		}
+	case *ExportStatement:
+		r.resolveStmt(s.Decl)
+	case *ImportStatement:
+		s.Module = r.load(s)
+		if s.Module != nil {
+			for _, name := range s.Names {
+				if !s.Module.exports[name.Export.String()] {
+					r.report(name.Export, fmt.Sprintf("%s does not export %s", s.Module, name.Export))
+				}
+			}
+		}
+		for _, id := range s.Bindings() {
+			if r.declared(id) {
+				r.report(id, fmt.Sprintf("variable already declared: %s", id))
+			}
+			r.declare(id)
+		}
+	}
+}
+
+func (r *resolver) resolveExpr(expr Expression) {
+	switch e := expr.(type) {
+	case *Identifier:
+		if !r.bind(e) {
+			r.report(e, fmt.Sprintf("undefined variable: %s", e))
+		}
+	case *InterpolatedString:
+		for _, part := range e.Parts {
+			r.resolveExpr(part)
+		}
+	case *ArrayLiteral:
+		for _, elem := range e.Elements {
+			r.resolveExpr(elem)
+		}
+	case *MapLiteral:
+		for i, key := range e.Keys {
+			r.resolveExpr(key)
+			r.resolveExpr(e.Values[i])
+		}
+	case *BinaryExpression:
+		r.resolveExpr(e.Left)
+		r.resolveExpr(e.Right)
+	case *UnaryExpression:
+		r.resolveExpr(e.Right)
+	case *PostfixExpression:
+		r.resolveExpr(e.Left)
+		r.resolveExpr(e.Index)
+	case *FieldExpression:
+		r.resolveExpr(e.Left)
+	case *FunctionLiteral:
+		e.slots = r.resolveFunction(e.Args, e.Body)
+	case FunctionCallExpression:
+		if ident, ok := e.Callee.(*Identifier); ok {
+			if !r.bind(ident) {
+				r.report(e, fmt.Sprintf("undefined function: %s", ident))
+			}
+		} else {
+			r.resolveExpr(e.Callee)
+		}
+		for _, arg := range e.Args {
+			r.resolveExpr(arg)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeclarationsShadowBuiltins(t *testing.T) {
+	expectOutput(t, `let values := [1, 2]
+print(values)`, "[1.000000 2.000000]\n")
+	expectOutput(t, `func f { let keys := 3
+  return keys }
+print(f(), keys({1: 2}))`, "3.000000 [1.000000]\n")
+	expectOutput(t, `let input := 1
+let eprint := 2
+for has in [input + eprint] { print(has) }`, "3.000000\n")
+	expectOutput(t, `try { throw 1 } catch delete { print(delete) }`, "1.000000\n")
+	expectError(t, `let keys := 1
+let keys := 2`, "variable already declared: keys")
+	expectError(t, `let x := 1
+func f { let x := 2 }`, "variable already declared: x")
+}
+
+func TestUndeclaredNames(t *testing.T) {
+	expectError(t, `x = 1`, "undefined variable: x")
+	expectError(t, `print(y)`, "undefined variable: y")
+	expectError(t, `nope()`, "undefined function: nope")
+	expectError(t, `func f: a, a { }`, "duplicate argument: a")
+	// A nested function may use a variable declared after it.
+	expectOutput(t, `func outer {
+  func get { return later }
+  let later := "later"
+  return get()
+}
+print(outer())`, "later\n")
+}
+
+func TestBlockScopes(t *testing.T) {
+	expectOutput(t, `func f: a {
+  if a { let x := "then"
+    return x }
+  let x := "after"
+  return x
+}
+print(f(true), f(false))`, "then after\n")
+	expectOutput(t, `let i := 0
+while i < 2 { let seen := i
+  i = i + 1
+  print(seen) }`, "0.000000\n1.000000\n")
+	expectError(t, `if true { let y := 2 }
+print(y)`, "undefined variable: y")
+}
+
+func TestResolveReportsEveryError(t *testing.T) {
+	_, err := run(t, `print(a)
+func f { return b }
+c = 1`)
+	for _, want := range []string{"undefined variable: a", "undefined variable: b", "undefined variable: c"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to report %q", err, want)
+		}
+	}
+}
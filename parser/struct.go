@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StructType is a record type declared with a struct statement. Calling it
+// creates a record, with the arguments of the call giving its fields in
+// order, or passed to its init method if it has one.
+type StructType struct {
+	Name   string
+	Fields []string
+	// index maps each field name to its position in Fields.
+	index map[string]int
+	// methods take the record they are called on as their first
+	// argument, self.
+	methods map[string]Func
+}
+
+func NewStructType(name string, fields []string) *StructType {
+	t := &StructType{Name: name, Fields: fields, index: make(map[string]int, len(fields))}
+	for i, field := range fields {
+		t.index[field] = i
+	}
+	return t
+}
+
+// AddMethod adds a method to t. Its first argument receives the record it
+// is called on.
+func (t *StructType) AddMethod(name string, f Func) {
+	if t.methods == nil {
+		t.methods = make(map[string]Func)
+	}
+	t.methods[name] = f
+}
+
+func (t *StructType) Method(name string) (Func, bool) {
+	f, ok := t.methods[name]
+	return f, ok
+}
+
+// Field returns the position of the named field in t's records.
+func (t *StructType) Field(name string) (int, bool) {
+	i, ok := t.index[name]
+	return i, ok
+}
+
+// CheckArity reports whether a call with n arguments can create a record of
+// type t. It is checked before the arguments are evaluated.
+func (t *StructType) CheckArity(n int) error {
+	want := len(t.Fields)
+	if init, ok := t.Method("init"); ok {
+		want = len(init.ArgNames) - 1
+	}
+	if n > want {
+		return fmt.Errorf("too many arguments for struct %s", t.Name)
+	} else if n < want {
+		return fmt.Errorf("too few arguments for struct %s", t.Name)
+	}
+	return nil
+}
+
+// Construct creates a record of type t from arguments accepted by
+// CheckArity, for a type without an init method.
+func (t *StructType) Construct(args []Value) Value {
+	fields := make([]Value, len(args))
+	copy(fields, args)
+	return Value{Type: Record, Record: &RecordValue{Type: t, Fields: fields}}
+}
+
+// New creates a record of type t whose fields are all void, for its init
+// method to fill in.
+func (t *StructType) New() Value {
+	return Value{Type: Record, Record: &RecordValue{Type: t, Fields: make([]Value, len(t.Fields))}}
+}
+
+func (t *StructType) String() string {
+	return "struct " + t.Name
+}
+
+// RecordValue holds the fields of a Record value, in the order its type
+// declares them. Like arrays and maps, records are shared by reference.
+type RecordValue struct {
+	Type   *StructType
+	Fields []Value
+}
+
+func (r *RecordValue) String() string {
+	var b strings.Builder
+	b.WriteString(r.Type.Name)
+	b.WriteByte('{')
+	for i, field := range r.Type.Fields {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %s", field, r.Fields[i])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// bind returns method f bound to r. Calling the result passes r as self.
+func (r *RecordValue) bind(f Func) Value {
+	return Value{Type: Function, Function: f, Record: r}
+}
+
+// copy returns a copy of r whose fields are copied with c.
+func (r *RecordValue) copy(c *Copier) *RecordValue {
+	copied := &RecordValue{Fields: make([]Value, len(r.Fields))}
+	c.Remember(r, copied)
+	copied.Type = c.structType(r.Type)
+	for i, field := range r.Fields {
+		copied.Fields[i] = c.Value(field)
+	}
+	return copied
+}
+
+// Arity returns the number of arguments a call to function value v takes.
+// A bound method takes one fewer than its Func, whose first argument is
+// self.
+func Arity(v Value) int {
+	if v.Record != nil {
+		return len(v.Function.ArgNames) - 1
+	}
+	return len(v.Function.ArgNames)
+}
+
+// CallArgs returns the arguments a call to function value v passes to its
+// Func: args, preceded by the receiver if v is a bound method.
+func CallArgs(v Value, args []Value) []Value {
+	if v.Record == nil {
+		return args
+	}
+	return append([]Value{{Type: Record, Record: v.Record}}, args...)
+}
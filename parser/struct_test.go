@@ -0,0 +1,47 @@
+package parser
+
+import "testing"
+
+func TestRecords(t *testing.T) {
+	expectOutput(t, `struct Point { x, y }
+let p := Point(1, 2)
+p.x = p.x + 10
+let q := p
+q.y = 5
+print(p.x, p.y)`, "11.000000 5.000000\n")
+	expectError(t, `struct Point { x, y }
+Point(1)`, "too few arguments for struct Point")
+	expectError(t, `struct Point { x, y }
+Point(1, 2).z`, "Point has no field or method z")
+	expectError(t, `let n := 1
+n.x = 2`, "cannot assign to field x of Number")
+}
+
+func TestMethods(t *testing.T) {
+	expectOutput(t, `struct Counter { n
+  func init: start { self.n = start }
+  func inc { self.n = self.n + 1
+    return self }
+}
+let c := Counter(5)
+c.inc().inc()
+let inc := c.inc
+inc()
+print(c.n)`, "8.000000\n")
+}
+
+func TestMethodsCallEachOther(t *testing.T) {
+	expectOutput(t, `struct V { x, y
+  func len2 { return self.x * self.x + self.y * self.y }
+  func scaled: k { return V(self.x * k, self.y * k) }
+}
+print(V(1, 2).scaled(3).len2())`, "45.000000\n")
+	expectOutput(t, `struct P { x
+  func init: a, b { self.x = a + b } }
+print(P(1, 2).x)`, "3.000000\n")
+	expectError(t, `struct P { x
+  func init: a, b { self.x = a + b } }
+P(1)`, "too few arguments for struct P")
+	expectError(t, `struct Q { x
+  func x { return 1 } }`, "duplicate method: x")
+}
@@ -0,0 +1,181 @@
+package tiny
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/printchard/tiny-lang/lexer"
+	"github.com/printchard/tiny-lang/parser"
+)
+
+// Diagnostic is an error or warning found in a script before it runs.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	Msg     string
+	Warning bool
+	// formatted includes an excerpt of the offending source.
+	formatted string
+}
+
+func newDiagnostic(fset *lexer.FileSet, diag lexer.Diagnostic) Diagnostic {
+	pos := fset.Position(diag.Pos())
+	return Diagnostic{
+		File:      pos.Filename,
+		Line:      pos.Line,
+		Column:    pos.Column,
+		Msg:       diag.Message(),
+		Warning:   diag.Severity() == lexer.SeverityWarning,
+		formatted: diag.Format(fset),
+	}
+}
+
+func (d Diagnostic) String() string {
+	if d.Warning {
+		return fmt.Sprintf("[%s:%d:%d]: warning: %s", d.File, d.Line, d.Column, d.Msg)
+	}
+	return fmt.Sprintf("[%s:%d:%d]: %s", d.File, d.Line, d.Column, d.Msg)
+}
+
+// Format returns the diagnostic followed by the source line it refers to,
+// as the tiny-lang command prints it.
+func (d Diagnostic) Format() string {
+	return d.formatted
+}
+
+// SyntaxError reports a script that could not be run. Diagnostics holds
+// every error found, along with any warnings.
+type SyntaxError struct {
+	Diagnostics []Diagnostic
+}
+
+func newSyntaxError(fset *lexer.FileSet, diags lexer.Diagnostics) *SyntaxError {
+	e := &SyntaxError{}
+	for _, diag := range diags {
+		e.Diagnostics = append(e.Diagnostics, newDiagnostic(fset, diag))
+	}
+	return e
+}
+
+func (e *SyntaxError) Error() string {
+	var msgs []string
+	for _, diag := range e.Diagnostics {
+		msgs = append(msgs, diag.String())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// RuntimeError reports an error raised while a script was running. Line
+// and Column are zero when the error did not come from a particular place
+// in the script, such as an error returned by a native function.
+type RuntimeError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+	// Stack lists the calls to script functions that were in progress,
+	// innermost first.
+	Stack []Frame
+	// Thrown is the value of an uncaught throw statement, converted as
+	// Get converts globals. It is nil for other errors.
+	Thrown any
+	// fset locates the positions of the error for Format.
+	fset *lexer.FileSet
+	err  error
+}
+
+// Frame is a call to a script function, made at Line and Column of File.
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+	Column   int
+}
+
+// newRuntimeError converts err, raised by a script run from file, locating
+// its positions in fset.
+func newRuntimeError(fset *lexer.FileSet, file string, err error) *RuntimeError {
+	e := &RuntimeError{File: file, Msg: err.Error(), fset: fset, err: err}
+	var runtimeErr *parser.RuntimeError
+	if errors.As(err, &runtimeErr) {
+		pos := fset.Position(runtimeErr.Start)
+		e.File, e.Line, e.Column, e.Msg = pos.Filename, pos.Line, pos.Column, runtimeErr.Msg
+		for _, frame := range runtimeErr.Stack {
+			pos := fset.Position(frame.Start)
+			e.Stack = append(e.Stack, Frame{Function: frame.Function, File: pos.Filename, Line: pos.Line, Column: pos.Column})
+		}
+		if runtimeErr.Thrown != nil {
+			e.Thrown = fromValue(*runtimeErr.Thrown)
+		}
+	}
+	return e
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+	if e.File == "" {
+		return fmt.Sprintf("[Line %d:%d]: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("[%s:%d:%d]: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// Format returns the error followed by the source line it refers to and a
+// traceback of the calls in progress, when it came from a place in the
+// script.
+func (e *RuntimeError) Format() string {
+	var runtimeErr *parser.RuntimeError
+	if e.Line != 0 && errors.As(e.err, &runtimeErr) {
+		return runtimeErr.Format(e.fset)
+	}
+	return e.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.err
+}
+
+// CallError reports a Call that could not be made. Err is the underlying
+// error, such as a ConversionError for an argument, if there is one.
+type CallError struct {
+	Name string
+	Msg  string
+	Err  error
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("call to %s: %s", e.Name, e.Msg)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// The errors that stop a script when it runs out of budget. A RuntimeError
+// wraps them, so they can be told apart with errors.As.
+type (
+	// CanceledError reports a script stopped because its context was done.
+	// It wraps the context's error.
+	CanceledError = parser.CanceledError
+	// StepLimitError reports a script that executed too many statements.
+	StepLimitError = parser.StepLimitError
+	// DepthLimitError reports a script that nested its calls too deeply.
+	DepthLimitError = parser.DepthLimitError
+	// AllocationLimitError reports a script that created too many array
+	// elements.
+	AllocationLimitError = parser.AllocationLimitError
+)
+
+// ConversionError reports a Go value whose type has no tiny-lang
+// equivalent.
+type ConversionError struct {
+	Type reflect.Type
+}
+
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("cannot convert %s to a tiny-lang value", e.Type)
+}
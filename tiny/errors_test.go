@@ -0,0 +1,57 @@
+package tiny
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStackTraces(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(opts...)
+		_, err := in.Eval(`func inner: x {
+  return x - "a"
+}
+func outer {
+  return inner(1)
+}
+outer()`)
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) {
+			t.Fatalf("got %v, want a RuntimeError", err)
+		}
+		if runtimeErr.Line != 2 || runtimeErr.Column != 12 || runtimeErr.Msg != "type mismatch: Number and String" {
+			t.Errorf("error at %d:%d: %s", runtimeErr.Line, runtimeErr.Column, runtimeErr.Msg)
+		}
+		want := []Frame{
+			{Function: "inner", File: "<eval>", Line: 5, Column: 15},
+			{Function: "outer", File: "<eval>", Line: 7, Column: 6},
+		}
+		if !reflect.DeepEqual(runtimeErr.Stack, want) {
+			t.Errorf("stack = %+v, want %+v", runtimeErr.Stack, want)
+		}
+		for _, line := range []string{
+			`      return x - "a"`,
+			"  in inner, called from [<eval>:5:15]",
+			"  in outer, called from [<eval>:7:6]",
+		} {
+			if !strings.Contains(runtimeErr.Format(), line+"\n") {
+				t.Errorf("Format() =\n%s\nwant a line %q", runtimeErr.Format(), line)
+			}
+		}
+	})
+}
+
+func TestUncaughtThrow(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		_, err := New(opts...).Eval("func f { throw [1, \"x\"] }\nf()")
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) {
+			t.Fatalf("got %v, want a RuntimeError", err)
+		}
+		if !reflect.DeepEqual(runtimeErr.Thrown, []any{1.0, "x"}) || len(runtimeErr.Stack) != 1 {
+			t.Errorf("Thrown = %#v, Stack = %+v", runtimeErr.Thrown, runtimeErr.Stack)
+		}
+	})
+}
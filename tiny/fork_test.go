@@ -0,0 +1,116 @@
+package tiny
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// engines runs a test once on each engine.
+func engines(t *testing.T, test func(t *testing.T, opts ...Option)) {
+	t.Run("tree", func(t *testing.T) { test(t) })
+	t.Run("vm", func(t *testing.T) { test(t, WithVM()) })
+}
+
+func mustEval(t *testing.T, in *Interpreter, src string) any {
+	t.Helper()
+	v, err := in.Eval(src)
+	if err != nil {
+		t.Fatalf("Eval(%q): %v", src, err)
+	}
+	return v
+}
+
+func expect(t *testing.T, in *Interpreter, src string, want any) {
+	t.Helper()
+	if got := mustEval(t, in, src); got != want {
+		t.Errorf("Eval(%q) = %v, want %v", src, got, want)
+	}
+}
+
+func TestForkIsolatesCapturedLocals(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		base := New(opts...)
+		mustEval(t, base, `
+func counter {
+  let n := 0
+  return func { n = n + 1
+    return n }
+}
+let c := counter()
+func pair {
+  let k := 0
+  return [func { k = k + 1
+    return k }, func { return k }]
+}
+let p := pair()
+struct Box { v
+  func next { return c() }
+}`)
+		a, b := base.Fork(), base.Fork()
+		expect(t, a, "c()", 1.0)
+		expect(t, a, "c()", 2.0)
+		expect(t, b, "c()", 1.0)
+		expect(t, base, "c()", 1.0)
+		expect(t, a, "Box(0).next()", 3.0)
+
+		// Closures sharing a scope still share its copy.
+		expect(t, a, "p[0]() + p[0]() + p[1]()", 5.0)
+		expect(t, b, "p[1]()", 0.0)
+	})
+}
+
+func TestForkIsolatesModules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctr.tiny")
+	src := "export let n := 0\nexport func inc { n = n + 1\n  return n }\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engines(t, func(t *testing.T, opts ...Option) {
+		base := New(opts...)
+		mustEval(t, base, `import "`+filepath.ToSlash(path)+`" as ctr
+import { inc } from "`+filepath.ToSlash(path)+`"`)
+		a, b := base.Fork(), base.Fork()
+		expect(t, a, "ctr.inc()", 1.0)
+		expect(t, a, "inc()", 2.0)
+		expect(t, a, "ctr.n", 2.0)
+		expect(t, b, "ctr.inc()", 1.0)
+		expect(t, base, "ctr.n", 0.0)
+		expect(t, base, "inc()", 1.0)
+	})
+}
+
+func TestForksRunConcurrently(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		base := New(opts...)
+		mustEval(t, base, `
+func counter {
+  let n := 0
+  return func { n = n + 1
+    return n }
+}
+let c := counter()`)
+		snapshot := base.Snapshot()
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fork := snapshot.Fork()
+				for range 10 {
+					if _, err := fork.Eval("c()"); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if got, _ := fork.Eval("c()"); got != 11.0 {
+					t.Errorf("c() = %v after 10 calls in a fork, want 11", got)
+				}
+			}()
+		}
+		wg.Wait()
+		expect(t, base, "c()", 1.0)
+	})
+}
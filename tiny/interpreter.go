@@ -0,0 +1,318 @@
+// Package tiny embeds the tiny-lang interpreter in Go programs.
+//
+// An Interpreter owns a set of global variables that persist across calls
+// to Eval and RunFile, and that the host can read and write with Get and
+// Set. Values cross the boundary as plain Go values: tiny-lang numbers are
+// float64, strings are string, booleans are bool, arrays are []any, maps
+// are map[any]any, records are map[string]any keyed by field name, void is
+// nil and functions are Function.
+package tiny
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/printchard/tiny-lang/lexer"
+	"github.com/printchard/tiny-lang/parser"
+	"github.com/printchard/tiny-lang/vm"
+)
+
+type Interpreter struct {
+	env      *parser.Environment
+	machine  *vm.Machine
+	warnings func(Diagnostic)
+	limits   Limits
+	opts     []Option
+}
+
+type Option func(*Interpreter)
+
+// WithVM runs scripts on the bytecode VM instead of the tree-walking
+// interpreter.
+func WithVM() Option {
+	return func(in *Interpreter) {
+		in.machine = vm.New(in.env)
+	}
+}
+
+// WithWarnings calls handle with each warning found in a script that is
+// otherwise free of errors. Warnings are dropped by default.
+func WithWarnings(handle func(Diagnostic)) Option {
+	return func(in *Interpreter) {
+		in.warnings = handle
+	}
+}
+
+// Limits caps the resources a single Eval, RunFile or Call may use. Zero
+// fields are unlimited. A call made by a Go function that a script called
+// is part of the script's run, and counts towards its limits.
+type Limits = parser.Limits
+
+// WithLimits stops scripts that exceed limits with a StepLimitError,
+// DepthLimitError or AllocationLimitError.
+func WithLimits(limits Limits) Option {
+	return func(in *Interpreter) {
+		in.limits = limits
+	}
+}
+
+// WithStdin sets the stream the input builtin reads from.
+func WithStdin(r io.Reader) Option {
+	return func(in *Interpreter) {
+		in.env.SetIO(parser.IO{Stdin: r})
+	}
+}
+
+// WithStdout sets the stream print writes to.
+func WithStdout(w io.Writer) Option {
+	return func(in *Interpreter) {
+		in.env.SetIO(parser.IO{Stdout: w})
+	}
+}
+
+// WithStderr sets the stream eprint writes to.
+func WithStderr(w io.Writer) Option {
+	return func(in *Interpreter) {
+		in.env.SetIO(parser.IO{Stderr: w})
+	}
+}
+
+// New creates an interpreter. Unless options say otherwise, scripts use
+// the process's standard streams and run on the tree-walking interpreter.
+func New(opts ...Option) *Interpreter {
+	in := &Interpreter{env: parser.NewDefaultEnvironment(), opts: opts}
+	for _, opt := range opts {
+		opt(in)
+	}
+	return in
+}
+
+// Snapshot is a frozen copy of an interpreter's globals.
+type Snapshot struct {
+	env  *parser.Environment
+	opts []Option
+}
+
+// Snapshot captures the interpreter's globals. Forking the snapshot is
+// cheap, so an interpreter can be configured once and snapshotted, and the
+// snapshot forked for each script run.
+func (in *Interpreter) Snapshot() *Snapshot {
+	return &Snapshot{env: in.env.Snapshot(), opts: in.opts}
+}
+
+// Fork returns a new interpreter with the options this snapshot was taken
+// with, whose globals start as a copy of the snapshot's.
+func (s *Snapshot) Fork() *Interpreter {
+	in := &Interpreter{env: s.env.Fork(), opts: s.opts}
+	for _, opt := range s.opts {
+		opt(in)
+	}
+	return in
+}
+
+// Fork returns a new interpreter with the same options and a copy of this
+// one's globals. Changes made by either are not seen by the other.
+func (in *Interpreter) Fork() *Interpreter {
+	return in.Snapshot().Fork()
+}
+
+// Eval runs src and returns the value of its last statement if that is an
+// expression, or the value of a top level return.
+func (in *Interpreter) Eval(src string) (any, error) {
+	return in.EvalContext(context.Background(), src)
+}
+
+// EvalContext is like Eval, but stops the script with a CanceledError once
+// ctx is done.
+func (in *Interpreter) EvalContext(ctx context.Context, src string) (any, error) {
+	return in.run(ctx, "", src)
+}
+
+// RunFile runs the script at path, like Eval.
+func (in *Interpreter) RunFile(path string) (any, error) {
+	return in.RunFileContext(context.Background(), path)
+}
+
+// RunFileContext is like RunFile, but stops the script with a
+// CanceledError once ctx is done.
+func (in *Interpreter) RunFileContext(ctx context.Context, path string) (any, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return in.run(ctx, path, string(src))
+}
+
+// begin sets up the budget of a run, if it needs one, and returns a
+// function that removes it. A run started by a Go function while another
+// is in progress counts against the budget of the one in progress.
+func (in *Interpreter) begin(ctx context.Context) func() {
+	if in.env.Budget() != nil || ctx.Done() == nil && in.limits == (Limits{}) {
+		return func() {}
+	}
+	in.env.SetBudget(parser.NewBudget(ctx, in.limits))
+	return func() { in.env.SetBudget(nil) }
+}
+
+// run runs src, read from the file at path, or passed to Eval if path is
+// empty.
+func (in *Interpreter) run(ctx context.Context, path, src string) (any, error) {
+	file := path
+	if path == "" {
+		file = "<eval>"
+	}
+	stmts, err := in.compile(file, path, src)
+	if err != nil {
+		return nil, err
+	}
+
+	defer in.begin(ctx)()
+	var result parser.Value
+	if in.machine != nil {
+		result, err = in.machine.Run(stmts)
+	} else {
+		result, err = parser.Run(stmts, in.env)
+	}
+	var ret *parser.ReturnSignal
+	if errors.As(err, &ret) {
+		result, err = ret.Value, nil
+	}
+	if err != nil {
+		return nil, newRuntimeError(in.env.FileSet(), file, err)
+	}
+	return fromValue(result), nil
+}
+
+// compile adds src to the interpreter's FileSet as file, then lexes,
+// parses and resolves it, collecting the diagnostics of every stage and of
+// the modules it imports. Imports are relative to the directory of path,
+// or the working directory if path is empty.
+func (in *Interpreter) compile(file, path, src string) ([]parser.Statement, error) {
+	fset := in.env.FileSet()
+	f := fset.AddFile(file, src)
+	tokens, lexErr := lexer.New(f).Tokenize()
+	p := parser.New(f, tokens)
+	stmts, parseErr := p.Parse()
+
+	var diags lexer.Diagnostics
+	if lexErr != nil {
+		if !errors.As(lexErr, &diags) {
+			return nil, lexErr
+		}
+	}
+	diags = append(diags, p.Diagnostics()...)
+	if parseErr == nil {
+		diags = append(diags, parser.ResolveFile(stmts, in.env, path)...)
+	}
+
+	if lexErr != nil || parseErr != nil || diags.HasErrors() {
+		return nil, newSyntaxError(fset, diags)
+	}
+	if in.warnings != nil {
+		for _, diag := range diags {
+			in.warnings(newDiagnostic(fset, diag))
+		}
+	}
+	return stmts, nil
+}
+
+// Call calls the global function name with args converted to tiny-lang
+// values.
+func (in *Interpreter) Call(name string, args ...any) (any, error) {
+	return in.CallContext(context.Background(), name, args...)
+}
+
+// CallContext is like Call, but stops the function with a CanceledError
+// once ctx is done.
+func (in *Interpreter) CallContext(ctx context.Context, name string, args ...any) (any, error) {
+	fn, ok := in.env.Get(name)
+	if !ok {
+		return nil, &CallError{Name: name, Msg: "undefined function"}
+	}
+
+	values := make([]parser.Value, len(args))
+	for i, arg := range args {
+		value, err := toValue(arg)
+		if err != nil {
+			return nil, &CallError{Name: name, Msg: fmt.Sprintf("argument %d: %v", i+1, err), Err: err}
+		}
+		values[i] = value
+	}
+
+	defer in.begin(ctx)()
+	var result parser.Value
+	var err error
+	switch fn.Type {
+	case parser.NativeFunction:
+		result, err = fn.NativeFunction(in.env, values)
+	case parser.Function:
+		if arity := parser.Arity(fn); len(args) != arity {
+			return nil, &CallError{Name: name, Msg: fmt.Sprintf("expected %d arguments, got %d", arity, len(args))}
+		}
+		values = parser.CallArgs(fn, values)
+		if fn.Function.Closure != nil {
+			if in.machine == nil {
+				return nil, &CallError{Name: name, Msg: "function was compiled for the VM"}
+			}
+			result, err = in.machine.Call(fn, values)
+		} else {
+			result, err = fn.Function.Call(in.env, values)
+		}
+	default:
+		return nil, &CallError{Name: name, Msg: fmt.Sprintf("not a function: %s", fn.Type)}
+	}
+	if err != nil {
+		return nil, newRuntimeError(in.env.FileSet(), "", err)
+	}
+	return fromValue(result), nil
+}
+
+// Get returns the value of the global variable name.
+func (in *Interpreter) Get(name string) (any, bool) {
+	value, ok := in.env.Get(name)
+	if !ok {
+		return nil, false
+	}
+	return fromValue(value), true
+}
+
+// Set defines or replaces the global variable name. A Go function is
+// registered as with Register.
+func (in *Interpreter) Set(name string, value any) error {
+	if reflect.TypeOf(value) != nil && reflect.TypeOf(value).Kind() == reflect.Func {
+		return in.Register(name, value)
+	}
+	v, err := toValue(value)
+	if err != nil {
+		return err
+	}
+	in.env.Define(name, v)
+	return nil
+}
+
+// Register makes the Go function fn callable from scripts as the global
+// name. Arguments are converted to the function's parameter types, and it
+// may return a value, an error, or both:
+//
+//	in.Register("repeat", func(s string, n int) string {
+//		return strings.Repeat(s, n)
+//	})
+//
+// Calls with the wrong number or types of arguments, and errors returned
+// by fn, are reported as a RuntimeError at the call site.
+func (in *Interpreter) Register(name string, fn any) error {
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		return fmt.Errorf("cannot register %s: %T is not a function", name, fn)
+	}
+	value, err := nativeFunction(name, rv)
+	if err != nil {
+		return err
+	}
+	in.env.Define(name, value)
+	return nil
+}
@@ -0,0 +1,251 @@
+package tiny
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCallbacksSeeScriptGlobals(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(opts...)
+		in.Register("callDbl", func() (any, error) { return in.Call("dbl", 4) })
+		in.Register("getX", func() any {
+			x, _ := in.Get("x")
+			return x
+		})
+		in.Register("setX", func(x float64) error { return in.Set("x", x) })
+
+		expect(t, in, `func dbl: n { return n * 2 }
+callDbl()`, 8.0)
+		expect(t, in, `let x := 5
+x = x + 1
+getX()`, 6.0)
+		expect(t, in, `setX(10)
+x`, 10.0)
+	})
+}
+
+func TestNestedRuns(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(opts...)
+		in.Register("eval", func(src string) (any, error) { return in.Eval(src) })
+
+		expect(t, in, `func f: a { return a + eval("1 + 1") }
+f(1) + f(2)`, 7.0)
+		expect(t, in, `func g: a {
+  try { return a + eval("throw 5") } catch e { return e }
+}
+g(1)`, 5.0)
+		expect(t, in, `let k := 0
+while k < 3 { k = k + eval("k") + 1 }
+k`, 3.0)
+		expect(t, in, `func h: a { return a + eval("func twice: x { return x * 2 }
+twice(3)") }
+h(1)`, 7.0)
+	})
+}
+
+func TestLimitsApplyAfterNestedRuns(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(append(opts, WithLimits(Limits{Steps: 10000}))...)
+		in.Register("eval", func(src string) (any, error) { return in.Eval(src) })
+
+		_, err := in.Eval(`eval("1")
+let i := 0
+while i < 100000 { i = i + 1 }`)
+		var steps *StepLimitError
+		if !errors.As(err, &steps) {
+			t.Errorf("loop after a nested run: got %v, want a StepLimitError", err)
+		}
+
+		// Steps taken by a nested run count towards the outer run's limit.
+		_, err = in.Eval(`func spin { let k := 0
+  while k < 2000 { k = k + 1 } }
+let j := 0
+while j < 4 { eval("spin()")
+  j = j + 1 }`)
+		if !errors.As(err, &steps) {
+			t.Errorf("nested runs: got %v, want a StepLimitError", err)
+		}
+	})
+}
+
+func TestModulesSeeHostGlobals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lib.tiny")
+	src := `export func twice: n { return double(n) }
+export func get { return count }
+export func bump { count = 100
+  return count }
+export let tag := "lib"
+`
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(opts...)
+		in.Register("double", func(n float64) float64 { return n * 2 })
+		in.Set("count", 1.0)
+		in.Set("tag", "host")
+
+		mustEval(t, in, `import "`+filepath.ToSlash(path)+`" as lib`)
+		expect(t, in, "lib.twice(4)", 8.0)
+		expect(t, in, "lib.tag + tag", "libhost")
+		expect(t, in, `count = count + 1
+lib.get()`, 2.0)
+
+		// Assigning to a global of the program declares one in the module.
+		expect(t, in, "lib.bump() + lib.get()", 200.0)
+		expect(t, in, "count", 2.0)
+
+		// The module of a fork sees the fork's globals.
+		fork := in.Fork()
+		fork.Register("double", func(n float64) float64 { return n * 3 })
+		expect(t, fork, "lib.twice(5)", 15.0)
+		expect(t, in, "lib.twice(5)", 10.0)
+	})
+}
+
+func TestHostAPI(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(opts...)
+		expect(t, in, "1 + 2", 3.0)
+		expect(t, in, `"a" + "b"`, "ab")
+		expect(t, in, "1 < 2", true)
+		expect(t, in, "let v := 1", nil)
+		if got := mustEval(t, in, "[1, \"x\"]"); !reflect.DeepEqual(got, []any{1.0, "x"}) {
+			t.Errorf("array = %#v", got)
+		}
+		if got := mustEval(t, in, `{"a": [true]}`); !reflect.DeepEqual(got, map[any]any{"a": []any{true}}) {
+			t.Errorf("map = %#v", got)
+		}
+
+		// Globals persist across runs and are shared with the host.
+		if v, ok := in.Get("v"); !ok || v != 1.0 {
+			t.Errorf("Get(v) = %v, %v", v, ok)
+		}
+		if _, ok := in.Get("missing"); ok {
+			t.Error("Get(missing) found a value")
+		}
+		if err := in.Set("names", []string{"b", "a"}); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, in, "names[1] + names[0]", "ab")
+		mustEval(t, in, "func add: a, b { return a + b }")
+		if got, err := in.Call("add", 2, 3); err != nil || got != 5.0 {
+			t.Errorf("Call(add) = %v, %v", got, err)
+		}
+
+		var callErr *CallError
+		if _, err := in.Call("add", 1); !errors.As(err, &callErr) || callErr.Msg != "expected 2 arguments, got 1" {
+			t.Errorf("Call(add, 1): got %v", err)
+		}
+		if _, err := in.Call("nope"); !errors.As(err, &callErr) || callErr.Msg != "undefined function" {
+			t.Errorf("Call(nope): got %v", err)
+		}
+		if err := in.Set("ch", make(chan int)); err == nil {
+			t.Error("Set(ch) converted a channel")
+		}
+
+		var syntaxErr *SyntaxError
+		if _, err := in.Eval("let := 1\nprint(q)"); !errors.As(err, &syntaxErr) || len(syntaxErr.Diagnostics) == 0 {
+			t.Errorf("bad syntax: got %v", err)
+		}
+		var runtimeErr *RuntimeError
+		if _, err := in.Eval("let w := 1\nw()"); !errors.As(err, &runtimeErr) || runtimeErr.Line != 2 {
+			t.Errorf("runtime error: got %v", err)
+		}
+	})
+}
+
+func TestInterpretersAreIsolated(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		a, b := New(opts...), New(opts...)
+		mustEval(t, a, `let x := "a"`)
+		mustEval(t, b, `let x := "b"`)
+		a.Register("only", func() string { return "a" })
+		expect(t, a, "x + only()", "aa")
+		expect(t, b, "x", "b")
+		if _, err := b.Eval("only()"); err == nil {
+			t.Error("b sees a function registered with a")
+		}
+
+		// Interpreters may run at the same time.
+		var wg sync.WaitGroup
+		for i := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				in := New(opts...)
+				in.Set("n", i)
+				if got, err := in.Eval("let k := 0\nwhile k < 100 { k = k + 1 }\nk + n"); err != nil || got != float64(100+i) {
+					t.Errorf("run %d = %v, %v", i, got, err)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestRedirectedStreams(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		var stdout, stderr strings.Builder
+		stdin := strings.NewReader("Ada\r\nBob")
+		in := New(append(opts, WithStdin(stdin), WithStdout(&stdout), WithStderr(&stderr))...)
+		mustEval(t, in, `let name := input("name? ")
+print("hi", name)
+eprint("second:", input())
+print(input() == void)`)
+		if want := "name? hi Ada\ntrue\n"; stdout.String() != want {
+			t.Errorf("stdout = %q, want %q", stdout.String(), want)
+		}
+		if want := "second: Bob\n"; stderr.String() != want {
+			t.Errorf("stderr = %q, want %q", stderr.String(), want)
+		}
+
+		// Forks write to the same streams.
+		stdout.Reset()
+		mustEval(t, in.Fork(), `print("fork")`)
+		if stdout.String() != "fork\n" {
+			t.Errorf("fork wrote %q", stdout.String())
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(append(opts, WithLimits(Limits{Steps: 1000, Depth: 20, ArrayElements: 10}))...)
+		mustEval(t, in, `func down: n { if n > 0 { return down(n - 1) } }
+let i := 0`)
+
+		var steps *StepLimitError
+		if _, err := in.Eval("while true { i = i + 1 }"); !errors.As(err, &steps) || steps.Limit != 1000 {
+			t.Errorf("endless loop: got %v", err)
+		}
+		var depth *DepthLimitError
+		if _, err := in.Eval("down(100)"); !errors.As(err, &depth) {
+			t.Errorf("deep recursion: got %v", err)
+		}
+		var allocation *AllocationLimitError
+		if _, err := in.Eval("[1, 2, 3, 4, 5, 6]\n[7, 8, 9, 10, 11]"); !errors.As(err, &allocation) {
+			t.Errorf("large arrays: got %v", err)
+		}
+		// Scripts cannot catch them, and each run starts a new budget.
+		if _, err := in.Eval("try { down(100) } catch e { }"); !errors.As(err, &depth) {
+			t.Errorf("caught limit: got %v", err)
+		}
+		expect(t, in, "down(10)", nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var canceled *CanceledError
+		if _, err := New(opts...).EvalContext(ctx, "while true { }"); !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) {
+			t.Errorf("canceled run: got %v", err)
+		}
+	})
+}
@@ -0,0 +1,426 @@
+package tiny
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/printchard/tiny-lang/parser"
+)
+
+// Function is a tiny-lang function value. It can be stored in a global with
+// Set or passed back to a script as an argument.
+type Function struct {
+	value parser.Value
+}
+
+var (
+	functionType = reflect.TypeFor[Function]()
+	errorType    = reflect.TypeFor[error]()
+)
+
+// toValue converts a Go value for use by a script. Numbers of any kind
+// become Number, slices and arrays become Array, maps become Map with
+// their keys in sorted order, structs become Record, pointers and
+// interfaces are followed and Go functions become native functions.
+func toValue(v any) (parser.Value, error) {
+	if v == nil {
+		return parser.Value{}, nil
+	}
+	return valueOf(reflect.ValueOf(v))
+}
+
+func valueOf(rv reflect.Value) (parser.Value, error) {
+	if rv.Type() == functionType {
+		return rv.Interface().(Function).value, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return parser.Value{Type: parser.Boolean, Boolean: rv.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return parser.Value{Type: parser.Number, Number: float64(rv.Int())}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return parser.Value{Type: parser.Number, Number: float64(rv.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return parser.Value{Type: parser.Number, Number: rv.Float()}, nil
+	case reflect.String:
+		return parser.Value{Type: parser.String, Str: rv.String()}, nil
+	case reflect.Slice, reflect.Array:
+		elems := make([]parser.Value, rv.Len())
+		for i := range elems {
+			elem, err := valueOf(rv.Index(i))
+			if err != nil {
+				return parser.Value{}, err
+			}
+			elems[i] = elem
+		}
+		return parser.Value{Type: parser.Array, Array: elems}, nil
+	case reflect.Map:
+		return mapOf(rv)
+	case reflect.Struct:
+		return recordOf(rv)
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return parser.Value{}, nil
+		}
+		return valueOf(rv.Elem())
+	case reflect.Func:
+		if rv.IsNil() {
+			return parser.Value{}, nil
+		}
+		return nativeFunction(rv.Type().String(), rv)
+	default:
+		return parser.Value{}, &ConversionError{Type: rv.Type()}
+	}
+}
+
+// mapOf converts a Go map. Go does not order its keys, so they are sorted
+// to give the script a deterministic order.
+func mapOf(rv reflect.Value) (parser.Value, error) {
+	type entry struct{ key, value parser.Value }
+	var entries []entry
+	iter := rv.MapRange()
+	for iter.Next() {
+		key, err := valueOf(iter.Key())
+		if err != nil {
+			return parser.Value{}, err
+		}
+		if key.Type != parser.Number && key.Type != parser.String && key.Type != parser.Boolean {
+			return parser.Value{}, &ConversionError{Type: iter.Key().Type()}
+		}
+		value, err := valueOf(iter.Value())
+		if err != nil {
+			return parser.Value{}, err
+		}
+		entries = append(entries, entry{key, value})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return compareKeys(a.key, b.key)
+	})
+
+	m := parser.NewOrderedMap()
+	for _, e := range entries {
+		m.Set(e.key, e.value)
+	}
+	return parser.Value{Type: parser.Map, Map: m}, nil
+}
+
+// goStruct describes how a Go struct type is seen by scripts: the record
+// type its values become and the index of the Go field behind each record
+// field.
+type goStruct struct {
+	typ    *parser.StructType
+	fields []int
+}
+
+// goStructs caches the goStruct of each Go type converted so far, so that
+// all values of a type share one record type.
+var goStructs sync.Map
+
+// goStructOf returns the record type for Go struct type t. Its fields are
+// the exported fields of t, named as in Go unless a `tiny:"name"` tag
+// renames them; a field tagged `tiny:"-"` is left out. Embedded structs are
+// fields like any other.
+func goStructOf(t reflect.Type) *goStruct {
+	if s, ok := goStructs.Load(t); ok {
+		return s.(*goStruct)
+	}
+	var names []string
+	var fields []int
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("tiny"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		names = append(names, name)
+		fields = append(fields, i)
+	}
+	name := t.Name()
+	if name == "" {
+		name = "struct"
+	}
+	s, _ := goStructs.LoadOrStore(t, &goStruct{typ: parser.NewStructType(name, names), fields: fields})
+	return s.(*goStruct)
+}
+
+// recordOf converts a Go struct.
+func recordOf(rv reflect.Value) (parser.Value, error) {
+	s := goStructOf(rv.Type())
+	fields := make([]parser.Value, len(s.fields))
+	for i, index := range s.fields {
+		field, err := valueOf(rv.Field(index))
+		if err != nil {
+			return parser.Value{}, err
+		}
+		fields[i] = field
+	}
+	return s.typ.Construct(fields), nil
+}
+
+// compareKeys orders map keys by type, then by value.
+func compareKeys(a, b parser.Value) int {
+	if a.Type != b.Type {
+		return cmp.Compare(a.Type, b.Type)
+	}
+	switch a.Type {
+	case parser.Number:
+		return cmp.Compare(a.Number, b.Number)
+	case parser.String:
+		return strings.Compare(a.Str, b.Str)
+	default:
+		if a.Boolean == b.Boolean {
+			return 0
+		} else if b.Boolean {
+			return -1
+		}
+		return 1
+	}
+}
+
+// fromValue converts a script value to the Go value the host sees when it
+// does not ask for a particular type.
+func fromValue(v parser.Value) any {
+	switch v.Type {
+	case parser.Number:
+		return v.Number
+	case parser.String:
+		return v.Str
+	case parser.Boolean:
+		return v.Boolean
+	case parser.Array:
+		elems := make([]any, len(v.Array))
+		for i, elem := range v.Array {
+			elems[i] = fromValue(elem)
+		}
+		return elems
+	case parser.Map:
+		m := make(map[any]any, v.Map.Len())
+		for i := range v.Map.Len() {
+			key, value := v.Map.Entry(i)
+			m[fromValue(key)] = fromValue(value)
+		}
+		return m
+	case parser.Record:
+		m := make(map[string]any, len(v.Record.Fields))
+		for i, name := range v.Record.Type.Fields {
+			m[name] = fromValue(v.Record.Fields[i])
+		}
+		return m
+	case parser.Function, parser.NativeFunction:
+		return Function{value: v}
+	default:
+		return nil
+	}
+}
+
+// goValue converts a script value to Go type t.
+func goValue(v parser.Value, t reflect.Type) (reflect.Value, error) {
+	if t == functionType {
+		if v.Type != parser.Function && v.Type != parser.NativeFunction {
+			return reflect.Value{}, fmt.Errorf("expected Function, got %s", v.Type)
+		}
+		return reflect.ValueOf(Function{value: v}), nil
+	}
+
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() > 0 {
+			return reflect.Value{}, fmt.Errorf("cannot convert %s to %s", v.Type, t)
+		}
+		if g := fromValue(v); g != nil {
+			rv.Set(reflect.ValueOf(g))
+		}
+	case reflect.Bool:
+		if v.Type != parser.Boolean {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		rv.SetBool(v.Boolean)
+	case reflect.String:
+		if v.Type != parser.String {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		rv.SetString(v.Str)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := integer(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if n < math.MinInt64 || n >= math.MaxInt64 || rv.OverflowInt(int64(n)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", n, t)
+		}
+		rv.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := integer(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if n < 0 || n >= math.MaxUint64 || rv.OverflowUint(uint64(n)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", n, t)
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		if v.Type != parser.Number {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		rv.SetFloat(v.Number)
+	case reflect.Slice:
+		if v.Type != parser.Array {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		rv.Set(reflect.MakeSlice(t, len(v.Array), len(v.Array)))
+		if err := setElems(rv, v.Array); err != nil {
+			return reflect.Value{}, err
+		}
+	case reflect.Array:
+		if v.Type != parser.Array {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		if len(v.Array) != t.Len() {
+			return reflect.Value{}, fmt.Errorf("expected %s, got an array of length %d", t, len(v.Array))
+		}
+		if err := setElems(rv, v.Array); err != nil {
+			return reflect.Value{}, err
+		}
+	case reflect.Map:
+		if v.Type != parser.Map {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		rv.Set(reflect.MakeMapWithSize(t, v.Map.Len()))
+		for i := range v.Map.Len() {
+			key, value := v.Map.Entry(i)
+			k, err := goValue(key, t.Key())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %s: %w", key, err)
+			}
+			e, err := goValue(value, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("value of key %s: %w", key, err)
+			}
+			rv.SetMapIndex(k, e)
+		}
+	case reflect.Struct:
+		if v.Type != parser.Record {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type)
+		}
+		// Fields the record does not have keep their zero value.
+		s := goStructOf(t)
+		for i, name := range s.typ.Fields {
+			j, ok := v.Record.Type.Field(name)
+			if !ok {
+				continue
+			}
+			f, err := goValue(v.Record.Fields[j], t.Field(s.fields[i]).Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("field %s: %w", name, err)
+			}
+			rv.Field(s.fields[i]).Set(f)
+		}
+	case reflect.Pointer:
+		if v.Type == parser.Void {
+			break
+		}
+		elem, err := goValue(v, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		rv.Set(reflect.New(t.Elem()))
+		rv.Elem().Set(elem)
+	default:
+		return reflect.Value{}, fmt.Errorf("cannot convert %s to %s", v.Type, t)
+	}
+	return rv, nil
+}
+
+func integer(v parser.Value, t reflect.Type) (float64, error) {
+	if v.Type != parser.Number {
+		return 0, fmt.Errorf("expected %s, got %s", t, v.Type)
+	}
+	if v.Number != math.Trunc(v.Number) {
+		return 0, fmt.Errorf("expected %s, got %v", t, v.Number)
+	}
+	return v.Number, nil
+}
+
+func setElems(rv reflect.Value, elems []parser.Value) error {
+	for i, elem := range elems {
+		ev, err := goValue(elem, rv.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
+		}
+		rv.Index(i).Set(ev)
+	}
+	return nil
+}
+
+// nativeFunction wraps the Go function fn so scripts can call it as name.
+// It may return a single value, an error, or a value and an error.
+func nativeFunction(name string, fn reflect.Value) (parser.Value, error) {
+	t := fn.Type()
+	switch {
+	case t.NumOut() == 0:
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return parser.Value{}, fmt.Errorf("%s must return at most a value and an error", name)
+	}
+
+	numIn := t.NumIn()
+	call := func(_ *parser.Environment, args []parser.Value) (parser.Value, error) {
+		if !t.IsVariadic() && len(args) > numIn {
+			return parser.Value{}, fmt.Errorf("too many arguments for function %s", name)
+		}
+		if t.IsVariadic() && len(args) < numIn-1 || !t.IsVariadic() && len(args) < numIn {
+			return parser.Value{}, fmt.Errorf("too few arguments for function %s", name)
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var paramType reflect.Type
+			if t.IsVariadic() && i >= numIn-1 {
+				paramType = t.In(numIn - 1).Elem()
+			} else {
+				paramType = t.In(i)
+			}
+			v, err := goValue(arg, paramType)
+			if err != nil {
+				return parser.Value{}, fmt.Errorf("argument %d of %s: %v", i+1, name, err)
+			}
+			in[i] = v
+		}
+
+		out := fn.Call(in)
+		if len(out) == 0 {
+			return parser.Value{}, nil
+		}
+		if last := out[len(out)-1]; last.Type() == errorType {
+			if !last.IsNil() {
+				return parser.Value{}, last.Interface().(error)
+			}
+			out = out[:len(out)-1]
+			if len(out) == 0 {
+				return parser.Value{}, nil
+			}
+		}
+		result, err := valueOf(out[0])
+		if err != nil {
+			return parser.Value{}, fmt.Errorf("result of %s: %v", name, err)
+		}
+		return result, nil
+	}
+	return parser.Value{Type: parser.NativeFunction, NativeFunction: call}, nil
+}
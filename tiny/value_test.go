@@ -0,0 +1,64 @@
+package tiny
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y   int
+	Label  string `tiny:"label"`
+	Hidden bool   `tiny:"-"`
+}
+
+func TestRegister(t *testing.T) {
+	engines(t, func(t *testing.T, opts ...Option) {
+		in := New(opts...)
+		in.Register("repeat", func(s string, n int) string { return strings.Repeat(s, n) })
+		in.Register("sum", func(ns ...float64) float64 {
+			total := 0.0
+			for _, n := range ns {
+				total += n
+			}
+			return total
+		})
+		in.Register("move", func(p point, by map[string]int) point {
+			p.X += by["x"]
+			return p
+		})
+		in.Register("fail", func() (int, error) { return 0, errors.New("boom") })
+		in.Register("keep", func(f Function) error { return in.Set("kept", f) })
+		in.Register("origin", func() *point { return &point{Label: "o", Hidden: true} })
+
+		expect(t, in, `repeat("ab", 3)`, "ababab")
+		expect(t, in, "sum() + sum(1, 2, 3)", 6.0)
+		if got := mustEval(t, in, `move(origin(), {"x": 2})`); !reflect.DeepEqual(got, map[string]any{"X": 2.0, "Y": 0.0, "label": "o"}) {
+			t.Errorf("move = %#v", got)
+		}
+		mustEval(t, in, "keep(func: n { return n * 10 })")
+		expect(t, in, "kept(4)", 40.0)
+
+		for src, want := range map[string]string{
+			`repeat("a")`:       "too few arguments for function repeat",
+			`repeat("a", 1, 2)`: "too many arguments for function repeat",
+			`repeat(1, 2)`:      "argument 1 of repeat: expected string, got Number",
+			`repeat("a", 1.5)`:  "argument 2 of repeat: expected int, got 1.5",
+			`fail()`:            "boom",
+		} {
+			_, err := in.Eval(src)
+			var runtimeErr *RuntimeError
+			if !errors.As(err, &runtimeErr) || runtimeErr.Msg != want {
+				t.Errorf("Eval(%q): got %v, want %q", src, err, want)
+			}
+		}
+	})
+
+	in := New()
+	for _, fn := range []any{nil, 1, func() (int, int) { return 0, 0 }} {
+		if err := in.Register("bad", fn); err == nil {
+			t.Errorf("Register(%T) succeeded", fn)
+		}
+	}
+}
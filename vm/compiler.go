@@ -0,0 +1,781 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/printchard/tiny-lang/lexer"
+	"github.com/printchard/tiny-lang/parser"
+)
+
+// Proto is a compiled function body, or the top level of a program.
+type Proto struct {
+	Name     string
+	ArgNames []string
+	NumSlots int
+	// HasCells is set when some local is captured by a nested function, so
+	// frames running this proto need a cell table.
+	HasCells bool
+	Code     []Instr
+	// Nodes holds the AST node each instruction was compiled from, so that
+	// runtime errors point at the same source as the tree-walker's.
+	Nodes  []parser.Node
+	Consts []parser.Value
+	// Globals names the global variables the code addresses, by the index
+	// given to the global instructions. Each machine maps them to its own
+	// globals, so code compiled by one machine can run on another, such as
+	// one running a fork of its Environment.
+	Globals  []string
+	Protos   []*Proto
+	Captures []Capture
+}
+
+// Capture describes where a new closure takes one of its free variables
+// from: a cell of the enclosing frame, or a free variable of the enclosing
+// closure.
+type Capture struct {
+	Local bool
+	Index int
+}
+
+func (p *Proto) Disassemble() string {
+	var b strings.Builder
+	p.disassemble(&b, "")
+	return b.String()
+}
+
+func (p *Proto) disassemble(b *strings.Builder, indent string) {
+	fmt.Fprintf(b, "%sproto %s(%s) slots=%d\n", indent, p.Name, strings.Join(p.ArgNames, ", "), p.NumSlots)
+	for i, instr := range p.Code {
+		fmt.Fprintf(b, "%s  %04d %s", indent, i, instr)
+		switch instr.Op() {
+		case OpConst:
+			fmt.Fprintf(b, " (%v)", p.Consts[instr.Arg()])
+		case OpGetGlobal, OpSetGlobal, OpDefineGlobal, OpCheckUndeclared:
+			fmt.Fprintf(b, " (%s)", p.Globals[instr.Arg()])
+		}
+		b.WriteByte('\n')
+	}
+	for _, child := range p.Protos {
+		child.disassemble(b, indent+"  ")
+	}
+}
+
+type CompileError struct {
+	Msg string
+	lexer.Token
+}
+
+func (e *CompileError) Error() string {
+	return e.Msg
+}
+
+type local struct {
+	name     string
+	slot     int
+	declared bool
+	captured bool
+	// refs are the instructions addressing the local's slot, rewritten to
+	// their cell form if the local turns out to be captured.
+	refs []int
+}
+
+type scope struct {
+	locals []*local
+}
+
+// loop collects the jumps of the break and continue statements in a loop's
+// body, patched once the loop's exit and next iteration are known.
+type loop struct {
+	label     *lexer.Token
+	breaks    []int
+	continues []int
+}
+
+// tryBlock is a try statement whose body or catch clause is being
+// compiled. Statements that jump out of it must first remove its handlers
+// and run its finally clause.
+type tryBlock struct {
+	// handlers is the number of handlers in effect: one for the catch
+	// clause while compiling the body, and one for the finally clause.
+	handlers int
+	finally  []parser.Statement
+	// loops, scopes and nextSlot are the compiler's state when the try
+	// statement started.
+	loops    int
+	scopes   int
+	nextSlot int
+}
+
+type compiler struct {
+	m      *Machine
+	parent *compiler
+	proto  *Proto
+	scopes []*scope
+	// decls maps the identifier of each hoisted declaration to its local.
+	decls    map[*parser.Identifier]*local
+	locals   []*local
+	loops    []*loop
+	tries    []*tryBlock
+	nextSlot int
+	numbers  map[float64]int
+	strings  map[string]int
+	globals  map[string]int
+	err      error
+}
+
+func newCompiler(m *Machine, parent *compiler, name string) *compiler {
+	return &compiler{
+		m:       m,
+		parent:  parent,
+		proto:   &Proto{Name: name},
+		decls:   make(map[*parser.Identifier]*local),
+		numbers: make(map[float64]int),
+		strings: make(map[string]int),
+		globals: make(map[string]int),
+	}
+}
+
+// Compile compiles a program for this machine. Top level declarations
+// become globals shared with the machine's Environment.
+func (m *Machine) Compile(stmts []parser.Statement) (*Proto, error) {
+	c := newCompiler(m, nil, "<main>")
+	// The value of a trailing expression statement is the program's result,
+	// which the REPL prints.
+	var returned bool
+	for i, stmt := range stmts {
+		if expr, ok := stmt.(parser.ExpressionStatement); ok && i == len(stmts)-1 {
+			c.emit(stmt, OpStep, 0)
+			c.compileExpr(expr.Expr)
+			c.emit(stmt, OpReturn, 0)
+			returned = true
+			break
+		}
+		c.compileStmt(stmt)
+	}
+	if !returned {
+		c.emit(nil, OpVoid, 0)
+		c.emit(nil, OpReturn, 0)
+	}
+	c.finish()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.proto, nil
+}
+
+func (c *compiler) emit(node parser.Node, op Opcode, arg int) int {
+	if arg > maxOperand && c.err == nil {
+		c.err = &CompileError{Msg: "program too large", Token: node.GetToken()}
+	}
+	c.proto.Code = append(c.proto.Code, makeInstr(op, arg))
+	c.proto.Nodes = append(c.proto.Nodes, node)
+	return len(c.proto.Code) - 1
+}
+
+func (c *compiler) emitLocal(node parser.Node, op Opcode, l *local) {
+	l.refs = append(l.refs, c.emit(node, op, l.slot))
+}
+
+func (c *compiler) patchJump(at int) {
+	c.patchJumpTo(at, len(c.proto.Code))
+}
+
+func (c *compiler) patchJumpTo(at, target int) {
+	c.proto.Code[at] = makeInstr(c.proto.Code[at].Op(), target)
+}
+
+// findLoop returns the loop a break or continue for label leaves. The
+// parser has checked that it exists.
+func (c *compiler) findLoop(label *lexer.Token) *loop {
+	for i := len(c.loops) - 1; i >= 0; i-- {
+		l := c.loops[i]
+		if label == nil || l.label != nil && l.label.Literal == label.Literal {
+			return l
+		}
+	}
+	return nil
+}
+
+// exitTries leaves the try statements from index from on, innermost first,
+// before a jump out of them.
+func (c *compiler) exitTries(node parser.Node, from int) {
+	for i := len(c.tries) - 1; i >= from; i-- {
+		t := c.tries[i]
+		for range t.handlers {
+			c.emit(node, OpEndTry, 0)
+		}
+		if t.finally == nil {
+			continue
+		}
+		// The finally clause runs outside the try statement, so it is
+		// compiled as it would be there. The slots of the locals it leaves
+		// are free to reuse.
+		tries, loops, scopes, nextSlot := c.tries, c.loops, c.scopes, c.nextSlot
+		c.tries, c.loops = c.tries[:i:i], c.loops[:t.loops:t.loops]
+		c.scopes, c.nextSlot = c.scopes[:t.scopes:t.scopes], t.nextSlot
+		c.compileBlock(t.finally)
+		c.tries, c.loops, c.scopes, c.nextSlot = tries, loops, scopes, nextSlot
+	}
+}
+
+// triesInLoop returns the index of the first try statement inside loop l.
+func (c *compiler) triesInLoop(l *loop) int {
+	depth := slices.Index(c.loops, l)
+	for i, t := range c.tries {
+		if t.loops > depth {
+			return i
+		}
+	}
+	return len(c.tries)
+}
+
+// compileLoopBody compiles the body of a loop, patching the continue
+// statements in it to jump to next and the break statements to the end of
+// the loop, which the caller compiles after calling emitNext.
+func (c *compiler) compileLoopBody(label *lexer.Token, body []parser.Statement, emitNext func() int) {
+	l := &loop{label: label}
+	c.loops = append(c.loops, l)
+	c.compileBlock(body)
+	c.loops = c.loops[:len(c.loops)-1]
+	next := emitNext()
+	for _, at := range l.continues {
+		c.patchJumpTo(at, next)
+	}
+	for _, at := range l.breaks {
+		c.patchJump(at)
+	}
+}
+
+func (c *compiler) numberConstant(n float64) int {
+	if i, ok := c.numbers[n]; ok {
+		return i
+	}
+	c.proto.Consts = append(c.proto.Consts, parser.Value{Type: parser.Number, Number: n})
+	c.numbers[n] = len(c.proto.Consts) - 1
+	return len(c.proto.Consts) - 1
+}
+
+func (c *compiler) stringConstant(str string) int {
+	if i, ok := c.strings[str]; ok {
+		return i
+	}
+	c.proto.Consts = append(c.proto.Consts, parser.Value{Type: parser.String, Str: str})
+	c.strings[str] = len(c.proto.Consts) - 1
+	return len(c.proto.Consts) - 1
+}
+
+// global returns the index of the global variable name in the proto's
+// Globals.
+func (c *compiler) global(name string) int {
+	if i, ok := c.globals[name]; ok {
+		return i
+	}
+	c.proto.Globals = append(c.proto.Globals, name)
+	c.globals[name] = len(c.proto.Globals) - 1
+	return len(c.proto.Globals) - 1
+}
+
+func (c *compiler) raise(node parser.Node, msg string) {
+	c.emit(node, OpRaise, c.stringConstant(msg))
+}
+
+// finish rewrites the slot instructions of captured locals to use cells and
+// drops the cell setup of locals that were never captured.
+func (c *compiler) finish() {
+	code := c.proto.Code
+	for _, l := range c.locals {
+		if l.captured {
+			c.proto.HasCells = true
+		}
+		for _, ref := range l.refs {
+			op := code[ref].Op()
+			switch {
+			case l.captured && op == OpGetLocal:
+				op = OpGetCell
+			case l.captured && op == OpSetLocal:
+				op = OpSetCell
+			case l.captured && op == OpDefineLocal:
+				op = OpDefineCell
+			case !l.captured && (op == OpNewCell || op == OpArgCell):
+				op = OpNop
+			}
+			code[ref] = makeInstr(op, code[ref].Arg())
+		}
+	}
+}
+
+func (c *compiler) addLocal(s *scope, name string) *local {
+	l := &local{name: name, slot: c.nextSlot}
+	c.nextSlot++
+	if c.nextSlot > c.proto.NumSlots {
+		c.proto.NumSlots = c.nextSlot
+	}
+	s.locals = append(s.locals, l)
+	c.locals = append(c.locals, l)
+	return l
+}
+
+// beginBlock opens a scope and reserves slots for every declaration in it,
+// so nested functions can refer to locals declared after them, as they can
+// when the tree-walker looks names up at call time.
+func (c *compiler) beginBlock(stmts []parser.Statement) {
+	s := &scope{}
+	c.scopes = append(c.scopes, s)
+	c.hoist(s, stmts)
+}
+
+func (c *compiler) hoist(s *scope, stmts []parser.Statement) {
+	for _, stmt := range stmts {
+		var ident *parser.Identifier
+		switch stmt := stmt.(type) {
+		case *parser.DeclarationStatement:
+			ident = stmt.Identifier
+		case *parser.FunctionStatement:
+			ident = stmt.Name
+		case *parser.StructStatement:
+			ident = stmt.Name
+		default:
+			continue
+		}
+		l := c.addLocal(s, ident.String())
+		c.decls[ident] = l
+		c.emitLocal(stmt, OpNewCell, l)
+	}
+}
+
+func (c *compiler) endBlock() {
+	s := c.scopes[len(c.scopes)-1]
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.nextSlot -= len(s.locals)
+}
+
+func (c *compiler) isGlobalScope() bool {
+	return c.parent == nil && len(c.scopes) == 0
+}
+
+func (c *compiler) findLocal(name string, declaredOnly bool) *local {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		locals := c.scopes[i].locals
+		for j := len(locals) - 1; j >= 0; j-- {
+			if locals[j].name == name && (locals[j].declared || !declaredOnly) {
+				return locals[j]
+			}
+		}
+	}
+	return nil
+}
+
+// resolveFree finds name among the locals of enclosing functions and
+// returns the index of the free variable holding it, or -1.
+func (c *compiler) resolveFree(name string) int {
+	if c.parent == nil {
+		return -1
+	}
+	var capture Capture
+	if l := c.parent.findLocal(name, false); l != nil {
+		l.captured = true
+		capture = Capture{Local: true, Index: l.slot}
+	} else if idx := c.parent.resolveFree(name); idx >= 0 {
+		capture = Capture{Index: idx}
+	} else {
+		return -1
+	}
+	for i, existing := range c.proto.Captures {
+		if existing == capture {
+			return i
+		}
+	}
+	c.proto.Captures = append(c.proto.Captures, capture)
+	return len(c.proto.Captures) - 1
+}
+
+func (c *compiler) declaredOutside(name string) bool {
+	for p := c.parent; p != nil; p = p.parent {
+		if p.findLocal(name, true) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compiler) loadVar(node parser.Node, name string) {
+	if l := c.findLocal(name, true); l != nil {
+		c.emitLocal(node, OpGetLocal, l)
+	} else if idx := c.resolveFree(name); idx >= 0 {
+		c.emit(node, OpGetFree, idx)
+	} else {
+		c.emit(node, OpGetGlobal, c.global(name))
+	}
+}
+
+func (c *compiler) storeVar(node parser.Node, name string) {
+	if l := c.findLocal(name, true); l != nil {
+		c.emitLocal(node, OpSetLocal, l)
+	} else if idx := c.resolveFree(name); idx >= 0 {
+		c.emit(node, OpSetFree, idx)
+	} else {
+		c.emit(node, OpSetGlobal, c.global(name))
+	}
+}
+
+func (c *compiler) compileBlock(stmts []parser.Statement) {
+	c.beginBlock(stmts)
+	for _, stmt := range stmts {
+		c.compileStmt(stmt)
+	}
+	c.endBlock()
+}
+
+func (c *compiler) compileStmt(stmt parser.Statement) {
+	c.emit(stmt, OpStep, 0)
+	if export, ok := stmt.(*parser.ExportStatement); ok {
+		// Exporting a declaration only matters to the files importing it.
+		stmt = export.Decl
+	}
+	switch s := stmt.(type) {
+	case *parser.DeclarationStatement:
+		name := s.Identifier.String()
+		if c.isGlobalScope() {
+			g := c.global(name)
+			c.emit(s, OpCheckUndeclared, g)
+			c.compileExpr(s.Value)
+			c.emit(s, OpDefineGlobal, g)
+			return
+		}
+		if c.findLocal(name, true) != nil || c.declaredOutside(name) {
+			c.raise(s, fmt.Sprintf("variable already declared: %s", name))
+			return
+		}
+		c.emit(s, OpCheckUndeclared, c.global(name))
+		c.compileExpr(s.Value)
+		l := c.decls[s.Identifier]
+		l.declared = true
+		c.emitLocal(s, OpDefineLocal, l)
+	case *parser.AssignmentStatement:
+		c.compileExpr(s.Value)
+		c.storeVar(s, s.Identifier.String())
+	case *parser.IndexAssignmentStatement:
+		c.compileExpr(s.Left)
+		c.emit(s, OpCheckIndexTarget, 0)
+		c.compileExpr(s.Index)
+		c.compileExpr(s.Value)
+		c.emit(s, OpSetIndex, 0)
+	case *parser.FieldAssignmentStatement:
+		field := c.stringConstant(s.Target.Field.Literal)
+		c.compileExpr(s.Target.Left)
+		c.emit(s.Target, OpCheckFieldTarget, field)
+		c.compileExpr(s.Value)
+		c.emit(s, OpSetField, field)
+	case *parser.IfStatement:
+		c.compileExpr(s.Condition)
+		elseJump := c.emit(s, OpJumpIfFalse, 0)
+		c.compileBlock(s.Then)
+		endJump := c.emit(s, OpJump, 0)
+		c.patchJump(elseJump)
+		c.compileBlock(s.Else)
+		c.patchJump(endJump)
+	case *parser.WhileStatement:
+		start := c.emit(s, OpStep, 0)
+		c.compileExpr(s.Condition)
+		exitJump := c.emit(s, OpJumpIfFalse, 0)
+		c.compileLoopBody(s.Label, s.Body, func() int {
+			c.emit(s, OpJump, start)
+			return start
+		})
+		c.patchJump(exitJump)
+	case *parser.ForStatement:
+		c.compileFor(s)
+	case *parser.BreakStatement:
+		l := c.findLoop(s.Label)
+		c.exitTries(s, c.triesInLoop(l))
+		l.breaks = append(l.breaks, c.emit(s, OpJump, 0))
+	case *parser.ContinueStatement:
+		l := c.findLoop(s.Label)
+		c.exitTries(s, c.triesInLoop(l))
+		l.continues = append(l.continues, c.emit(s, OpJump, 0))
+	case *parser.TryStatement:
+		c.compileTry(s)
+	case *parser.ThrowStatement:
+		c.compileExpr(s.Value)
+		c.emit(s, OpThrow, 0)
+	case *parser.ImportStatement:
+		// Imports are only allowed at the top level, so they bind globals.
+		for _, id := range s.Bindings() {
+			c.emit(id, OpCheckUndeclared, c.global(id.String()))
+		}
+		if s.Name != nil {
+			c.emit(s, OpImport, 0)
+			c.emit(s, OpDefineGlobal, c.global(s.Name.String()))
+			return
+		}
+		for _, name := range s.Names {
+			c.emit(s, OpImport, 0)
+			c.emit(s, OpGetField, c.stringConstant(name.Export.String()))
+			c.emit(s, OpDefineGlobal, c.global(name.Alias.String()))
+		}
+	case parser.ExpressionStatement:
+		c.compileExpr(s.Expr)
+		c.emit(s, OpPop, 0)
+	case *parser.FunctionStatement:
+		name := s.Name.String()
+		c.compileFunction(s, name, s.Args, s.Body)
+		if c.isGlobalScope() {
+			c.emit(s, OpDefineGlobal, c.global(name))
+			return
+		}
+		l := c.decls[s.Name]
+		l.declared = true
+		c.emitLocal(s, OpDefineLocal, l)
+	case *parser.StructStatement:
+		for _, method := range s.Methods {
+			c.compileFunction(method, s.MethodName(method), method.Args, method.Body)
+		}
+		c.emit(s, OpStruct, len(s.Methods))
+		if c.isGlobalScope() {
+			c.emit(s, OpDefineGlobal, c.global(s.Name.String()))
+			return
+		}
+		l := c.decls[s.Name]
+		l.declared = true
+		c.emitLocal(s, OpDefineLocal, l)
+	case *parser.ReturnStatement:
+		if s.Return == nil {
+			c.emit(s, OpVoid, 0)
+		} else {
+			c.compileExpr(s.Return)
+		}
+		c.exitTries(s, 0)
+		if c.parent == nil {
+			c.emit(s, OpTopReturn, 0)
+		} else {
+			c.emit(s, OpReturn, 0)
+		}
+	default:
+		if c.err == nil {
+			c.err = &CompileError{Msg: fmt.Sprintf("unsupported statement: %s", stmt), Token: stmt.GetToken()}
+		}
+	}
+}
+
+func (c *compiler) compileFor(s *parser.ForStatement) {
+	c.compileExpr(s.Iterable)
+	if s.End != nil {
+		c.compileExpr(s.End)
+	} else {
+		c.emit(s, OpVoid, 0)
+	}
+	state := &scope{}
+	c.scopes = append(c.scopes, state)
+	seq := c.addLocal(state, "")
+	c.addLocal(state, "")
+	c.addLocal(state, "")
+	c.emit(s, OpForInit, seq.slot)
+
+	start := c.emit(s, OpStep, 0)
+	c.emit(s, OpForNext, seq.slot)
+	exitJump := c.emit(s, OpJumpIfFalse, 0)
+
+	// The loop variables get new cells on every iteration, so closures
+	// created in the body keep the values of their own iteration.
+	vars := &scope{}
+	c.scopes = append(c.scopes, vars)
+	var index *local
+	if s.Index != nil {
+		index = c.addLocal(vars, s.Index.String())
+		index.declared = true
+		c.emitLocal(s, OpNewCell, index)
+	}
+	value := c.addLocal(vars, s.Value.String())
+	value.declared = true
+	c.emitLocal(s, OpNewCell, value)
+	c.emitLocal(s, OpDefineLocal, value)
+	if index != nil {
+		c.emitLocal(s, OpDefineLocal, index)
+	} else {
+		c.emit(s, OpPop, 0)
+	}
+	c.compileLoopBody(s.Label, s.Body, func() int {
+		c.emit(s, OpJump, start)
+		return start
+	})
+	c.endBlock()
+	c.patchJump(exitJump)
+	c.endBlock()
+}
+
+// compileTry compiles a try statement. Its finally clause is compiled once
+// for when the statement ends normally or with an error, which is kept in a
+// hidden slot to be rethrown afterwards, and once more for each statement
+// that jumps out of it.
+func (c *compiler) compileTry(s *parser.TryStatement) {
+	t := &tryBlock{finally: s.Finally, loops: len(c.loops), scopes: len(c.scopes), nextSlot: c.nextSlot}
+	state := &scope{}
+	c.scopes = append(c.scopes, state)
+	var pending *local
+	var finallyHandler int
+	if s.Finally != nil {
+		pending = c.addLocal(state, "")
+		finallyHandler = c.emit(s, OpTry, 0)
+		t.handlers++
+	}
+	var catchHandler int
+	if s.Catch != nil {
+		catchHandler = c.emit(s, OpTry, 0)
+		t.handlers++
+	}
+	c.tries = append(c.tries, t)
+	c.compileBlock(s.Body)
+
+	if s.Catch != nil {
+		c.emit(s, OpEndTry, 0)
+		t.handlers--
+		skip := c.emit(s, OpJump, 0)
+		c.patchJump(catchHandler)
+		c.emit(s, OpCatch, 0)
+		vars := &scope{}
+		c.scopes = append(c.scopes, vars)
+		if s.CatchVar != nil {
+			l := c.addLocal(vars, s.CatchVar.String())
+			l.declared = true
+			c.emitLocal(s, OpNewCell, l)
+			c.emitLocal(s, OpDefineLocal, l)
+		} else {
+			c.emit(s, OpPop, 0)
+		}
+		c.compileBlock(s.Catch)
+		c.endBlock()
+		c.patchJump(skip)
+	}
+	c.tries = c.tries[:len(c.tries)-1]
+
+	if s.Finally != nil {
+		c.emit(s, OpEndTry, 0)
+		c.emit(s, OpConst, c.numberConstant(0))
+		c.patchJump(finallyHandler)
+		c.emitLocal(s, OpDefineLocal, pending)
+		c.compileBlock(s.Finally)
+		c.emit(s, OpEndFinally, pending.slot)
+	}
+	c.endBlock()
+}
+
+var binaryOps = map[lexer.TokenType]Opcode{
+	lexer.PlusToken:     OpAdd,
+	lexer.MinusToken:    OpSub,
+	lexer.MultiplyToken: OpMul,
+	lexer.DivideToken:   OpDiv,
+	lexer.EqualToken:    OpEqual,
+	lexer.NotEqualToken: OpNotEqual,
+	lexer.LTToken:       OpLess,
+	lexer.LEQToken:      OpLessEqual,
+	lexer.GTToken:       OpGreater,
+	lexer.GEQToken:      OpGreaterEqual,
+	lexer.AndToken:      OpAnd,
+	lexer.OrToken:       OpOr,
+}
+
+func (c *compiler) compileExpr(expr parser.Expression) {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		c.emit(e, OpConst, c.numberConstant(e.Value))
+	case *parser.StringLiteral:
+		c.emit(e, OpConst, c.stringConstant(e.Value))
+	case *parser.BooleanLiteral:
+		if e.Value {
+			c.emit(e, OpTrue, 0)
+		} else {
+			c.emit(e, OpFalse, 0)
+		}
+	case parser.VoidLiteral:
+		c.emit(e, OpVoid, 0)
+	case *parser.InterpolatedString:
+		for _, part := range e.Parts {
+			c.compileExpr(part)
+		}
+		c.emit(e, OpConcat, len(e.Parts))
+	case *parser.ArrayLiteral:
+		for _, elem := range e.Elements {
+			c.compileExpr(elem)
+		}
+		c.emit(e, OpArray, len(e.Elements))
+	case *parser.MapLiteral:
+		c.emit(e, OpMap, 0)
+		for i, key := range e.Keys {
+			c.compileExpr(key)
+			c.compileExpr(e.Values[i])
+			c.emit(key, OpMapInsert, 0)
+		}
+	case *parser.Identifier:
+		c.loadVar(e, e.String())
+	case *parser.BinaryExpression:
+		c.compileExpr(e.Left)
+		c.compileExpr(e.Right)
+		op, ok := binaryOps[e.Op]
+		if !ok {
+			c.raise(e, fmt.Sprintf("unknown operator: %s", e.Op))
+			return
+		}
+		c.emit(e, op, 0)
+	case *parser.UnaryExpression:
+		c.compileExpr(e.Right)
+		switch e.Op {
+		case lexer.MinusToken:
+			c.emit(e, OpNeg, 0)
+		default:
+			c.emit(e, OpNot, 0)
+		}
+	case *parser.PostfixExpression:
+		c.compileExpr(e.Left)
+		c.compileExpr(e.Index)
+		c.emit(e, OpIndex, 0)
+	case *parser.FieldExpression:
+		c.compileExpr(e.Left)
+		c.emit(e, OpGetField, c.stringConstant(e.Field.Literal))
+	case *parser.FunctionLiteral:
+		c.compileFunction(e, "<func>", e.Args, e.Body)
+	case parser.FunctionCallExpression:
+		if ident, ok := e.Callee.(*parser.Identifier); ok {
+			// Attributed to the call so a missing callee reports
+			// "undefined function" like the tree-walker.
+			c.loadVar(e, ident.String())
+		} else {
+			c.compileExpr(e.Callee)
+		}
+		c.emit(e, OpCheckCall, len(e.Args))
+		for _, arg := range e.Args {
+			c.compileExpr(arg)
+		}
+		c.emit(e, OpCall, len(e.Args))
+	default:
+		if c.err == nil {
+			c.err = &CompileError{Msg: fmt.Sprintf("unsupported expression: %s", expr), Token: expr.GetToken()}
+		}
+	}
+}
+
+func (c *compiler) compileFunction(node parser.Node, name string, args []*parser.Identifier, body []parser.Statement) {
+	fc := newCompiler(c.m, c, name)
+	s := &scope{}
+	fc.scopes = append(fc.scopes, s)
+	for _, arg := range args {
+		fc.proto.ArgNames = append(fc.proto.ArgNames, arg.String())
+		l := fc.addLocal(s, arg.String())
+		l.declared = true
+		fc.emitLocal(node, OpArgCell, l)
+	}
+	fc.hoist(s, body)
+	for _, stmt := range body {
+		fc.compileStmt(stmt)
+	}
+	fc.emit(node, OpVoid, 0)
+	fc.emit(node, OpReturn, 0)
+	fc.finish()
+	if fc.err != nil && c.err == nil {
+		c.err = fc.err
+	}
+
+	c.proto.Protos = append(c.proto.Protos, fc.proto)
+	c.emit(node, OpClosure, len(c.proto.Protos)-1)
+}
@@ -0,0 +1,190 @@
+package vm
+
+import "fmt"
+
+type Opcode uint8
+
+const (
+	OpNop Opcode = iota
+	// OpStep counts a statement or loop iteration against the run's
+	// budget.
+	OpStep
+	OpConst
+	OpVoid
+	OpTrue
+	OpFalse
+	OpPop
+
+	// Locals live in stack slots. A local captured by a nested function is
+	// kept in a heap cell instead; the compiler emits the slot form and
+	// rewrites it to the cell form once it knows the local is captured.
+	OpGetLocal
+	OpSetLocal
+	OpDefineLocal
+	OpGetCell
+	OpSetCell
+	OpDefineCell
+	OpNewCell
+	OpArgCell
+	OpGetFree
+	OpSetFree
+
+	OpGetGlobal
+	OpSetGlobal
+	OpDefineGlobal
+	OpCheckUndeclared
+
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEqual
+	OpNotEqual
+	OpLess
+	OpLessEqual
+	OpGreater
+	OpGreaterEqual
+	OpAnd
+	OpOr
+	OpNeg
+	OpNot
+
+	OpArray
+	// OpMap pushes an empty map, and OpMapInsert pops a key and value and
+	// adds them to the map below them.
+	OpMap
+	OpMapInsert
+	OpIndex
+	OpCheckIndexTarget
+	OpSetIndex
+	// OpStruct pops the closures of a struct statement's methods and
+	// pushes the new type it declares. The field instructions name their
+	// field with a string constant.
+	OpStruct
+	OpGetField
+	OpCheckFieldTarget
+	OpSetField
+	OpConcat
+
+	OpJump
+	OpJumpIfFalse
+	// A for loop keeps its sequence, the end of a range and the index of
+	// the next iteration in three consecutive hidden slots. OpForNext
+	// pushes the index and element of the next iteration followed by true,
+	// or only false once the loop is done.
+	OpForInit
+	OpForNext
+	OpClosure
+	OpCheckCall
+	OpCall
+	OpReturn
+	OpTopReturn
+	// OpTry registers a handler at its operand for the errors raised until
+	// the matching OpEndTry. A handler resumes with the error's index in
+	// the machine's pending errors pushed: OpCatch replaces it with the
+	// caught value, and OpEndFinally rethrows the error whose index is in
+	// its operand's slot, if any, after a finally clause.
+	OpTry
+	OpEndTry
+	OpCatch
+	OpEndFinally
+	OpThrow
+	// OpImport runs the top level of the module imported by its node, the
+	// first time it is imported, and pushes the module.
+	OpImport
+	OpRaise
+)
+
+var opcodeNames = [...]string{
+	OpNop:              "NOP",
+	OpStep:             "STEP",
+	OpConst:            "CONST",
+	OpVoid:             "VOID",
+	OpTrue:             "TRUE",
+	OpFalse:            "FALSE",
+	OpPop:              "POP",
+	OpGetLocal:         "GET_LOCAL",
+	OpSetLocal:         "SET_LOCAL",
+	OpDefineLocal:      "DEFINE_LOCAL",
+	OpGetCell:          "GET_CELL",
+	OpSetCell:          "SET_CELL",
+	OpDefineCell:       "DEFINE_CELL",
+	OpNewCell:          "NEW_CELL",
+	OpArgCell:          "ARG_CELL",
+	OpGetFree:          "GET_FREE",
+	OpSetFree:          "SET_FREE",
+	OpGetGlobal:        "GET_GLOBAL",
+	OpSetGlobal:        "SET_GLOBAL",
+	OpDefineGlobal:     "DEFINE_GLOBAL",
+	OpCheckUndeclared:  "CHECK_UNDECLARED",
+	OpAdd:              "ADD",
+	OpSub:              "SUB",
+	OpMul:              "MUL",
+	OpDiv:              "DIV",
+	OpEqual:            "EQUAL",
+	OpNotEqual:         "NOT_EQUAL",
+	OpLess:             "LESS",
+	OpLessEqual:        "LESS_EQUAL",
+	OpGreater:          "GREATER",
+	OpGreaterEqual:     "GREATER_EQUAL",
+	OpAnd:              "AND",
+	OpOr:               "OR",
+	OpNeg:              "NEG",
+	OpNot:              "NOT",
+	OpArray:            "ARRAY",
+	OpMap:              "MAP",
+	OpMapInsert:        "MAP_INSERT",
+	OpIndex:            "INDEX",
+	OpCheckIndexTarget: "CHECK_INDEX_TARGET",
+	OpSetIndex:         "SET_INDEX",
+	OpStruct:           "STRUCT",
+	OpGetField:         "GET_FIELD",
+	OpCheckFieldTarget: "CHECK_FIELD_TARGET",
+	OpSetField:         "SET_FIELD",
+	OpConcat:           "CONCAT",
+	OpJump:             "JUMP",
+	OpJumpIfFalse:      "JUMP_IF_FALSE",
+	OpForInit:          "FOR_INIT",
+	OpForNext:          "FOR_NEXT",
+	OpClosure:          "CLOSURE",
+	OpCheckCall:        "CHECK_CALL",
+	OpCall:             "CALL",
+	OpReturn:           "RETURN",
+	OpTopReturn:        "TOP_RETURN",
+	OpTry:              "TRY",
+	OpEndTry:           "END_TRY",
+	OpCatch:            "CATCH",
+	OpEndFinally:       "END_FINALLY",
+	OpThrow:            "THROW",
+	OpImport:           "IMPORT",
+	OpRaise:            "RAISE",
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opcodeNames) && opcodeNames[op] != "" {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("OP(%d)", op)
+}
+
+// Instr is a single instruction: the opcode in the low byte and a 24-bit
+// operand above it.
+type Instr uint32
+
+const maxOperand = 1<<24 - 1
+
+func makeInstr(op Opcode, arg int) Instr {
+	return Instr(uint32(arg)<<8 | uint32(op))
+}
+
+func (i Instr) Op() Opcode {
+	return Opcode(i & 0xff)
+}
+
+func (i Instr) Arg() int {
+	return int(i >> 8)
+}
+
+func (i Instr) String() string {
+	return fmt.Sprintf("%-18s %d", i.Op(), i.Arg())
+}
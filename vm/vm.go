@@ -0,0 +1,870 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/printchard/tiny-lang/lexer"
+	"github.com/printchard/tiny-lang/parser"
+)
+
+// Machine is a stack based virtual machine running programs compiled from
+// the parser's AST. It implements the same semantics as the tree-walking
+// interpreter, keeping locals in stack slots instead of Environment maps.
+// Globals are read from the Environment it was created with, and written
+// back to it before a native function is called and when a run ends, so
+// both engines can share builtins and REPL state with the host.
+type Machine struct {
+	env *parser.Environment
+	// globals caches the variables of env, and modules those of the
+	// imported modules whose code the machine has run.
+	globals globalTable
+	modules map[*parser.ModuleFile]*globalTable
+	stack   []parser.Value
+	sp      int
+	frames  []frame
+	// budget is the Environment's budget, read at the start of each run
+	// and restored when a run started by a native function ends.
+	budget *parser.Budget
+	// handlers are the try statements in progress, innermost last.
+	handlers []handler
+	// pending holds the errors caught by handlers until a catch clause
+	// takes them or a finally clause rethrows them.
+	pending []error
+}
+
+// handler is where a try statement resumes after an error: at pc in the
+// frame with index frame, with the operand stack cut back to sp.
+type handler struct {
+	frame int
+	sp    int
+	pc    int
+}
+
+type globalState uint8
+
+const (
+	globalUnknown globalState = iota
+	globalAbsent
+	globalPresent
+)
+
+// global caches an Environment variable for the duration of a run.
+type global struct {
+	value parser.Value
+	state globalState
+	dirty bool
+}
+
+// globalTable caches the variables of a global scope. Each name the code
+// run with it addresses is given an index into entries the first time a
+// proto using it runs, so the table only grows with the names of the
+// programs run in the scope.
+type globalTable struct {
+	env     *parser.Environment
+	names   []string
+	index   map[string]int
+	entries []global
+	// slots maps the Globals of each proto run with the table to their
+	// index in entries.
+	slots map[*Proto][]int
+	// version is the Environment's version when the cached values were
+	// last known to match it.
+	version int
+	// writeThrough is set for the globals of a module, whose exports the
+	// program can read while a run is in progress.
+	writeThrough bool
+	// program is set for the globals of a module to the machine's own,
+	// through which the module reads the globals of the program it was
+	// loaded by.
+	program *globalTable
+}
+
+// cell holds a local captured by a closure. It is undefined until the
+// local's declaration runs.
+type cell struct {
+	value   parser.Value
+	defined bool
+}
+
+type closure struct {
+	proto *Proto
+	free  []*cell
+	// module is the imported module the closure belongs to, or nil for
+	// code of the main program.
+	module *parser.ModuleFile
+}
+
+// Captures reports whether cl holds captured locals or belongs to a
+// module, which forks must copy.
+func (cl *closure) Captures() bool {
+	return len(cl.free) > 0 || cl.module != nil
+}
+
+// Fork returns a copy of cl for a forked environment, with copies of the
+// cells it captured and of its module.
+func (cl *closure) Fork(c *parser.Copier) any {
+	if copied, ok := c.Seen(cl); ok {
+		return copied
+	}
+	copied := &closure{proto: cl.proto, free: make([]*cell, len(cl.free))}
+	c.Remember(cl, copied)
+	copied.module = c.Module(cl.module)
+	for i, free := range cl.free {
+		if seen, ok := c.Seen(free); ok {
+			copied.free[i] = seen.(*cell)
+			continue
+		}
+		cell := &cell{defined: free.defined}
+		c.Remember(free, cell)
+		cell.value = c.Value(free.value)
+		copied.free[i] = cell
+	}
+	return copied
+}
+
+type frame struct {
+	cl    *closure
+	pc    int
+	base  int
+	cells []*cell
+	// globals are the globals the closure's code runs with, and slots the
+	// index in their entries of each of its proto's Globals.
+	globals *globalTable
+	slots   []int
+	// counted is set for frames entered by a call that counts towards the
+	// budget's depth.
+	counted bool
+	// constructor is set for a call to an init method, which returns the
+	// record it initialized, kept in the callee's slot below its arguments.
+	constructor bool
+}
+
+func New(env *parser.Environment) *Machine {
+	if env == nil {
+		env = parser.NewEnvironment(nil)
+	}
+	return &Machine{env: env, globals: globalTable{env: env}}
+}
+
+// slotsOf returns the index in t's entries of each of p's Globals.
+func (t *globalTable) slotsOf(p *Proto) []int {
+	if slots, ok := t.slots[p]; ok {
+		return slots
+	}
+	if t.slots == nil {
+		t.slots = make(map[*Proto][]int)
+	}
+	slots := make([]int, len(p.Globals))
+	for i, name := range p.Globals {
+		slots[i] = t.indexOf(name)
+	}
+	t.slots[p] = slots
+	return slots
+}
+
+// indexOf returns the index of name in t's entries, adding it if needed.
+func (t *globalTable) indexOf(name string) int {
+	if slot, ok := t.index[name]; ok {
+		return slot
+	}
+	if t.index == nil {
+		t.index = make(map[string]int)
+	}
+	slot := len(t.names)
+	t.names = append(t.names, name)
+	t.entries = append(t.entries, global{})
+	t.index[name] = slot
+	return slot
+}
+
+func (t *globalTable) load(i int) *global {
+	g := &t.entries[i]
+	if g.state == globalUnknown {
+		if t.program != nil && !t.env.Declared(t.names[i]) {
+			// The program's own table may hold changes not written back.
+			return t.program.load(t.program.indexOf(t.names[i]))
+		}
+		if v, ok := t.env.Get(t.names[i]); ok {
+			g.value, g.state = v, globalPresent
+		} else {
+			g.state = globalAbsent
+		}
+	}
+	return g
+}
+
+func (t *globalTable) store(i int, value parser.Value) {
+	g := &t.entries[i]
+	g.value, g.state = value, globalPresent
+	if t.writeThrough {
+		t.env.Define(t.names[i], value)
+	} else {
+		g.dirty = true
+	}
+}
+
+// flush writes the globals changed during a run back to the Environment
+// and forgets the cached values, which the host may change between runs.
+func (t *globalTable) flush() {
+	for i := range t.entries {
+		g := &t.entries[i]
+		if g.dirty {
+			t.env.Define(t.names[i], g.value)
+		}
+		*g = global{}
+	}
+}
+
+// writeBack writes the globals changed so far back to the Environment,
+// keeping the cached values.
+func (t *globalTable) writeBack() {
+	for i := range t.entries {
+		if g := &t.entries[i]; g.dirty {
+			t.env.Define(t.names[i], g.value)
+			g.dirty = false
+		}
+	}
+	t.version = t.env.Version()
+}
+
+// refresh forgets the cached values if the Environment has changed since
+// writeBack.
+func (t *globalTable) refresh() {
+	if t.env.Version() != t.version {
+		clear(t.entries)
+	}
+}
+
+func (m *Machine) flushGlobals() {
+	m.globals.flush()
+	for _, t := range m.modules {
+		t.flush()
+	}
+}
+
+// globalsOf returns the globals the code of cl runs with: those of the
+// module it belongs to, or the machine's own.
+func (m *Machine) globalsOf(cl *closure) *globalTable {
+	if cl.module == nil {
+		return &m.globals
+	}
+	t, ok := m.modules[cl.module]
+	if !ok {
+		if m.modules == nil {
+			m.modules = make(map[*parser.ModuleFile]*globalTable)
+		}
+		t = &globalTable{env: cl.module.Env, writeThrough: true, program: &m.globals}
+		m.modules[cl.module] = t
+	}
+	return t
+}
+
+// Run compiles and executes a program, returning the value of its last
+// statement when that is an expression statement.
+func (m *Machine) Run(stmts []parser.Statement) (parser.Value, error) {
+	proto, err := m.Compile(stmts)
+	if err != nil {
+		return parser.Value{}, err
+	}
+	return m.Execute(proto)
+}
+
+// Execute runs a compiled program. A native function may execute another
+// program while one is running, which runs on top of the calls in progress
+// and leaves them as they were.
+func (m *Machine) Execute(proto *Proto) (parser.Value, error) {
+	defer m.flushGlobals()
+	defer m.restore(m.save())
+	// The top level of a program only runs once.
+	defer func() { delete(m.globals.slots, proto) }()
+	sp, base := m.sp, len(m.frames)
+	m.push(parser.Value{})
+	m.enter(&closure{proto: proto}, 0)
+	result, err := m.run(base)
+	if err != nil {
+		m.trace(err, base)
+		m.unwind(sp, base)
+	}
+	return result, err
+}
+
+// state is the part of a machine's state that a run started by a native
+// function could leave changed.
+type state struct {
+	budget  *parser.Budget
+	pending int
+}
+
+// save starts a run with the Environment's budget, returning the state to
+// restore once the run is over.
+func (m *Machine) save() state {
+	s := state{budget: m.budget, pending: len(m.pending)}
+	m.budget = m.env.Budget()
+	return s
+}
+
+func (m *Machine) restore(s state) {
+	m.budget = s.budget
+	m.pending = m.pending[:s.pending]
+}
+
+// Call calls a function value created by this machine with args. The
+// caller is responsible for passing the right number of arguments.
+func (m *Machine) Call(fn parser.Value, args []parser.Value) (parser.Value, error) {
+	cl, ok := fn.Function.Closure.(*closure)
+	if fn.Type != parser.Function || !ok {
+		return parser.Value{}, fmt.Errorf("function was not compiled for the VM")
+	}
+	defer m.flushGlobals()
+	defer m.restore(m.save())
+	if m.budget != nil {
+		if err := m.budget.Enter(); err != nil {
+			return parser.Value{}, err
+		}
+	}
+	sp, base := m.sp, len(m.frames)
+	m.push(fn)
+	for _, arg := range args {
+		m.push(arg)
+	}
+	m.enter(cl, len(args))
+	m.frames[base].counted = m.budget != nil
+	result, err := m.run(base)
+	if err != nil {
+		m.trace(err, base)
+		m.unwind(sp, base)
+	}
+	return result, err
+}
+
+// trace records the calls above base that err unwound through, as the
+// tree-walker does when it leaves them.
+func (m *Machine) trace(err error, base int) {
+	for i := len(m.frames) - 1; i > base; i-- {
+		caller := &m.frames[i-1]
+		parser.AddStackFrame(err, m.frames[i].cl.proto.Name, caller.cl.proto.Nodes[caller.pc-1])
+	}
+}
+
+// importModule runs the top level of the module node imports, unless an
+// earlier import has, on top of the calls in progress.
+func (m *Machine) importModule(node *parser.ImportStatement) error {
+	module := node.Module
+	return module.Evaluate(node, func() error {
+		proto, err := m.Compile(module.Stmts)
+		if err != nil {
+			return err
+		}
+		sp, base := m.sp, len(m.frames)
+		m.push(parser.Value{})
+		m.enter(&closure{proto: proto, module: module}, 0)
+		globals := m.frames[base].globals
+		defer func() { delete(globals.slots, proto) }()
+		_, err = m.run(base)
+		if err != nil {
+			m.trace(err, base)
+			m.unwind(sp, base)
+		}
+		return err
+	})
+}
+
+// unwind drops the frames above base after an error, leaving the calls
+// they were running.
+func (m *Machine) unwind(sp, base int) {
+	for _, f := range m.frames[base:] {
+		if f.counted {
+			m.budget.Leave()
+		}
+	}
+	m.sp, m.frames = sp, m.frames[:base]
+	m.dropHandlers(base)
+}
+
+// dropHandlers forgets the handlers of the frames from index frame up.
+func (m *Machine) dropHandlers(frame int) {
+	for len(m.handlers) > 0 && m.handlers[len(m.handlers)-1].frame >= frame {
+		m.handlers = m.handlers[:len(m.handlers)-1]
+	}
+}
+
+// handle resumes at the innermost handler above base after err, reporting
+// whether there was one to catch it. The calls it leaves are recorded in
+// err's stack, as the tree-walker does.
+func (m *Machine) handle(err error, base int) bool {
+	if len(m.handlers) == 0 || !parser.Catchable(err) {
+		return false
+	}
+	h := m.handlers[len(m.handlers)-1]
+	if h.frame < base {
+		return false
+	}
+	m.handlers = m.handlers[:len(m.handlers)-1]
+	m.trace(err, h.frame)
+	for _, f := range m.frames[h.frame+1:] {
+		if f.counted {
+			m.budget.Leave()
+		}
+	}
+	m.frames = m.frames[:h.frame+1]
+	m.frames[h.frame].pc = h.pc
+	m.sp = h.sp
+	m.pending = append(m.pending, err)
+	m.push(parser.Value{Type: parser.Number, Number: float64(len(m.pending))})
+	return true
+}
+
+// takePending removes and returns the pending error with the given index,
+// along with any left above it by a finally clause that raised another.
+func (m *Machine) takePending(index int) error {
+	err := m.pending[index-1]
+	m.pending = m.pending[:index-1]
+	return err
+}
+
+func (m *Machine) push(v parser.Value) {
+	if m.sp == len(m.stack) {
+		m.stack = append(m.stack, v)
+	} else {
+		m.stack[m.sp] = v
+	}
+	m.sp++
+}
+
+func (m *Machine) pop() parser.Value {
+	m.sp--
+	return m.stack[m.sp]
+}
+
+// enter pushes a frame for cl whose nargs arguments are on top of the
+// stack, above the callee itself.
+func (m *Machine) enter(cl *closure, nargs int) {
+	f := frame{cl: cl, base: m.sp - nargs, globals: m.globalsOf(cl)}
+	f.slots = f.globals.slotsOf(cl.proto)
+	for i := nargs; i < cl.proto.NumSlots; i++ {
+		m.push(parser.Value{})
+	}
+	if cl.proto.HasCells {
+		f.cells = make([]*cell, cl.proto.NumSlots)
+	}
+	m.frames = append(m.frames, f)
+}
+
+func (m *Machine) errorAt(f *frame, msg string) error {
+	node := f.cl.proto.Nodes[f.pc-1]
+	if node == nil {
+		return &parser.RuntimeError{Msg: msg}
+	}
+	return parser.NewRuntimeError(node, msg)
+}
+
+// undefinedError mirrors the tree-walker's messages for a missing variable,
+// which depend on whether it was being called.
+func (m *Machine) undefinedError(f *frame, name string) error {
+	switch node := f.cl.proto.Nodes[f.pc-1].(type) {
+	case parser.FunctionCallExpression:
+		return m.errorAt(f, fmt.Sprintf("undefined function: %s", node.Callee))
+	case *parser.AssignmentStatement:
+		return m.errorAt(f, fmt.Sprintf("undefined variable: %s", node.Identifier))
+	case *parser.Identifier:
+		return m.errorAt(f, fmt.Sprintf("undefined variable: %s", node))
+	default:
+		return m.errorAt(f, fmt.Sprintf("undefined variable: %s", name))
+	}
+}
+
+// run executes instructions until the frame entered on top of the first
+// base frames returns. Errors raised inside a try statement resume at its
+// handler.
+func (m *Machine) run(base int) (parser.Value, error) {
+	for {
+		result, err := m.exec(base)
+		if err == nil || !m.handle(err, base) {
+			return result, err
+		}
+	}
+}
+
+func (m *Machine) exec(base int) (parser.Value, error) {
+	f := &m.frames[len(m.frames)-1]
+	code := f.cl.proto.Code
+
+	for {
+		instr := code[f.pc]
+		f.pc++
+
+		switch instr.Op() {
+		case OpNop:
+		case OpStep:
+			if m.budget != nil {
+				if err := m.budget.Step(); err != nil {
+					return parser.Value{}, parser.WrapRuntimeError(f.cl.proto.Nodes[f.pc-1], err)
+				}
+			}
+		case OpConst:
+			m.push(f.cl.proto.Consts[instr.Arg()])
+		case OpVoid:
+			m.push(parser.Value{})
+		case OpTrue:
+			m.push(parser.Value{Type: parser.Boolean, Boolean: true})
+		case OpFalse:
+			m.push(parser.Value{Type: parser.Boolean, Boolean: false})
+		case OpPop:
+			m.sp--
+
+		case OpGetLocal:
+			m.push(m.stack[f.base+instr.Arg()])
+		case OpSetLocal, OpDefineLocal:
+			m.stack[f.base+instr.Arg()] = m.pop()
+		case OpNewCell:
+			f.cells[instr.Arg()] = &cell{}
+		case OpArgCell:
+			f.cells[instr.Arg()] = &cell{value: m.stack[f.base+instr.Arg()], defined: true}
+		case OpGetCell:
+			c := f.cells[instr.Arg()]
+			if !c.defined {
+				return parser.Value{}, m.undefinedError(f, "")
+			}
+			m.push(c.value)
+		case OpSetCell:
+			c := f.cells[instr.Arg()]
+			if !c.defined {
+				return parser.Value{}, m.undefinedError(f, "")
+			}
+			c.value = m.pop()
+		case OpDefineCell:
+			c := f.cells[instr.Arg()]
+			c.value, c.defined = m.pop(), true
+		case OpGetFree:
+			c := f.cl.free[instr.Arg()]
+			if !c.defined {
+				return parser.Value{}, m.undefinedError(f, "")
+			}
+			m.push(c.value)
+		case OpSetFree:
+			c := f.cl.free[instr.Arg()]
+			if !c.defined {
+				return parser.Value{}, m.undefinedError(f, "")
+			}
+			c.value = m.pop()
+
+		case OpGetGlobal:
+			g := f.globals.load(f.slots[instr.Arg()])
+			if g.state != globalPresent {
+				return parser.Value{}, m.undefinedError(f, f.cl.proto.Globals[instr.Arg()])
+			}
+			m.push(g.value)
+		case OpSetGlobal:
+			if f.globals.load(f.slots[instr.Arg()]).state != globalPresent {
+				return parser.Value{}, m.undefinedError(f, f.cl.proto.Globals[instr.Arg()])
+			}
+			f.globals.store(f.slots[instr.Arg()], m.pop())
+		case OpDefineGlobal:
+			f.globals.store(f.slots[instr.Arg()], m.pop())
+		case OpCheckUndeclared:
+			// A global defined during the run may not be written back yet.
+			name := f.cl.proto.Globals[instr.Arg()]
+			if f.globals.entries[f.slots[instr.Arg()]].dirty || f.globals.env.Declared(name) {
+				return parser.Value{}, m.errorAt(f, fmt.Sprintf("variable already declared: %s", name))
+			}
+
+		case OpAdd, OpSub, OpMul, OpDiv, OpEqual, OpNotEqual, OpLess, OpLessEqual, OpGreater, OpGreaterEqual, OpAnd, OpOr:
+			right := m.pop()
+			left := m.pop()
+			result, err := binary(instr.Op(), left, right)
+			if err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+			m.push(result)
+		case OpNeg, OpNot:
+			op := lexer.MinusToken
+			if instr.Op() == OpNot {
+				op = lexer.NotToken
+			}
+			result, err := parser.UnaryOp(op, m.pop())
+			if err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+			m.push(result)
+
+		case OpArray:
+			n := instr.Arg()
+			var elems []parser.Value
+			if n > 0 {
+				elems = make([]parser.Value, n)
+				copy(elems, m.stack[m.sp-n:m.sp])
+				m.sp -= n
+			}
+			if m.budget != nil {
+				if err := m.budget.Allocate(n); err != nil {
+					return parser.Value{}, parser.WrapRuntimeError(f.cl.proto.Nodes[f.pc-1], err)
+				}
+			}
+			m.push(parser.Value{Type: parser.Array, Array: elems})
+		case OpMap:
+			m.push(parser.Value{Type: parser.Map, Map: parser.NewOrderedMap()})
+		case OpMapInsert:
+			value := m.pop()
+			key := m.pop()
+			if err := m.stack[m.sp-1].Map.Set(key, value); err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+		case OpIndex:
+			index := m.pop()
+			left := m.pop()
+			result, err := parser.Index(left, index)
+			if err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+			m.push(result)
+		case OpCheckIndexTarget:
+			if err := parser.CheckIndexTarget(m.stack[m.sp-1]); err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+		case OpSetIndex:
+			value := m.pop()
+			index := m.pop()
+			left := m.pop()
+			if err := parser.SetIndex(left, index, value); err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+		case OpStruct:
+			node := f.cl.proto.Nodes[f.pc-1].(*parser.StructStatement)
+			n := instr.Arg()
+			methods := make([]parser.Func, n)
+			for i, method := range m.stack[m.sp-n : m.sp] {
+				methods[i] = method.Function
+			}
+			m.sp -= n
+			m.push(parser.Value{Type: parser.Struct, Struct: node.NewType(methods)})
+		case OpGetField:
+			record := m.pop()
+			result, err := parser.GetField(record, f.cl.proto.Consts[instr.Arg()].Str)
+			if err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+			m.push(result)
+		case OpCheckFieldTarget:
+			if err := parser.CheckFieldTarget(m.stack[m.sp-1], f.cl.proto.Consts[instr.Arg()].Str); err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+		case OpSetField:
+			value := m.pop()
+			record := m.pop()
+			parser.SetField(record, f.cl.proto.Consts[instr.Arg()].Str, value)
+		case OpConcat:
+			n := instr.Arg()
+			result := parser.Concat(m.stack[m.sp-n : m.sp])
+			m.sp -= n
+			m.push(result)
+
+		case OpJump:
+			f.pc = instr.Arg()
+		case OpJumpIfFalse:
+			if !m.pop().AsBoolean() {
+				f.pc = instr.Arg()
+			}
+		case OpForInit:
+			end := m.pop()
+			iterable := m.pop()
+			node := f.cl.proto.Nodes[f.pc-1].(*parser.ForStatement)
+			seq, err := parser.ForSequence(iterable, end, node.End != nil)
+			if err != nil {
+				return parser.Value{}, m.errorAt(f, err.Error())
+			}
+			slots := m.stack[f.base+instr.Arg():]
+			slots[0], slots[1], slots[2] = seq, end, parser.Value{Type: parser.Number}
+		case OpForNext:
+			slots := m.stack[f.base+instr.Arg():]
+			index, elem, ok := parser.ForElement(slots[0], slots[1], int(slots[2].Number))
+			if !ok {
+				m.push(parser.Value{Type: parser.Boolean, Boolean: false})
+				continue
+			}
+			slots[2].Number++
+			if slots[0].Type == parser.Map && f.cl.proto.Nodes[f.pc-1].(*parser.ForStatement).Index == nil {
+				elem = index
+			}
+			m.push(index)
+			m.push(elem)
+			m.push(parser.Value{Type: parser.Boolean, Boolean: true})
+
+		case OpClosure:
+			proto := f.cl.proto.Protos[instr.Arg()]
+			cl := &closure{proto: proto, free: make([]*cell, len(proto.Captures)), module: f.cl.module}
+			for i, capture := range proto.Captures {
+				if capture.Local {
+					cl.free[i] = f.cells[capture.Index]
+				} else {
+					cl.free[i] = f.cl.free[capture.Index]
+				}
+			}
+			m.push(parser.Value{
+				Type:     parser.Function,
+				Function: parser.Func{Name: proto.Name, ArgNames: proto.ArgNames, Closure: cl},
+			})
+		case OpCheckCall:
+			if err := m.checkCall(f, m.stack[m.sp-1], instr.Arg()); err != nil {
+				return parser.Value{}, err
+			}
+		case OpCall:
+			n := instr.Arg()
+			callee := m.stack[m.sp-n-1]
+			if callee.Type == parser.NativeFunction {
+				args := make([]parser.Value, n)
+				copy(args, m.stack[m.sp-n:m.sp])
+				m.sp -= n + 1
+				// A native function may read or set globals through the
+				// Environment, as a host callback does when it calls back
+				// into the interpreter.
+				m.globals.writeBack()
+				result, err := callee.NativeFunction(m.env, args)
+				m.globals.refresh()
+				// A run started by the function may have moved the frames.
+				f = &m.frames[len(m.frames)-1]
+				if err != nil {
+					return parser.Value{}, parser.WrapRuntimeError(f.cl.proto.Nodes[f.pc-1], err)
+				}
+				m.push(result)
+				continue
+			}
+			fn, receiver, constructor := callee.Function, callee.Record, false
+			if callee.Type == parser.Struct {
+				init, ok := callee.Struct.Method("init")
+				if !ok {
+					record := callee.Struct.Construct(m.stack[m.sp-n : m.sp])
+					m.sp -= n + 1
+					m.push(record)
+					continue
+				}
+				record := callee.Struct.New()
+				m.stack[m.sp-n-1] = record
+				fn, receiver, constructor = init, record.Record, true
+			}
+			if receiver != nil {
+				// Pass the receiver of a method as its first argument.
+				m.push(parser.Value{})
+				copy(m.stack[m.sp-n:m.sp], m.stack[m.sp-n-1:m.sp-1])
+				m.stack[m.sp-n-1] = parser.Value{Type: parser.Record, Record: receiver}
+				n++
+			}
+			if m.budget != nil {
+				if err := m.budget.Enter(); err != nil {
+					return parser.Value{}, parser.WrapRuntimeError(f.cl.proto.Nodes[f.pc-1], err)
+				}
+			}
+			m.enter(fn.Closure.(*closure), n)
+			f = &m.frames[len(m.frames)-1]
+			f.counted = m.budget != nil
+			f.constructor = constructor
+			code = f.cl.proto.Code
+		case OpReturn:
+			if f.counted {
+				m.budget.Leave()
+			}
+			m.dropHandlers(len(m.frames) - 1)
+			result := m.pop()
+			if f.constructor {
+				result = m.stack[f.base-1]
+			}
+			m.sp = f.base - 1
+			m.frames = m.frames[:len(m.frames)-1]
+			if len(m.frames) == base {
+				return result, nil
+			}
+			m.push(result)
+			f = &m.frames[len(m.frames)-1]
+			code = f.cl.proto.Code
+		case OpTopReturn:
+			return parser.Value{}, &parser.ReturnSignal{Value: m.pop()}
+		case OpTry:
+			m.handlers = append(m.handlers, handler{frame: len(m.frames) - 1, sp: m.sp, pc: instr.Arg()})
+		case OpEndTry:
+			m.handlers = m.handlers[:len(m.handlers)-1]
+		case OpCatch:
+			err := m.takePending(int(m.pop().Number))
+			value, _ := parser.Caught(m.env, err)
+			m.push(value)
+		case OpEndFinally:
+			if index := int(m.stack[f.base+instr.Arg()].Number); index > 0 {
+				return parser.Value{}, m.takePending(index)
+			}
+		case OpThrow:
+			return parser.Value{}, parser.Throw(f.cl.proto.Nodes[f.pc-1], m.pop())
+		case OpImport:
+			node := f.cl.proto.Nodes[f.pc-1].(*parser.ImportStatement)
+			if err := m.importModule(node); err != nil {
+				return parser.Value{}, err
+			}
+			// Running the module may have moved the frames.
+			f = &m.frames[len(m.frames)-1]
+			m.push(parser.Value{Type: parser.Module, Module: node.Module})
+		case OpRaise:
+			return parser.Value{}, m.errorAt(f, f.cl.proto.Consts[instr.Arg()].Str)
+
+		default:
+			return parser.Value{}, m.errorAt(f, fmt.Sprintf("unknown opcode %s", instr.Op()))
+		}
+	}
+}
+
+func (m *Machine) checkCall(f *frame, callee parser.Value, nargs int) error {
+	call := f.cl.proto.Nodes[f.pc-1].(parser.FunctionCallExpression)
+	if callee.Type == parser.NativeFunction {
+		return nil
+	}
+	if callee.Type == parser.Struct {
+		if err := callee.Struct.CheckArity(nargs); err != nil {
+			return m.errorAt(f, err.Error())
+		}
+		if init, ok := callee.Struct.Method("init"); ok {
+			if _, ok := init.Closure.(*closure); !ok {
+				return m.errorAt(f, fmt.Sprintf("function %s was not compiled for the VM", init.Name))
+			}
+		}
+		return nil
+	}
+	if callee.Type != parser.Function {
+		return m.errorAt(f, fmt.Sprintf("function call to non-function type: %s", callee.Type))
+	}
+	if _, ok := callee.Function.Closure.(*closure); !ok {
+		return m.errorAt(f, fmt.Sprintf("function %s was not compiled for the VM", call.Callee))
+	}
+	if arity := parser.Arity(callee); nargs > arity {
+		return m.errorAt(f, fmt.Sprintf("too many arguments for function %s", call.Callee))
+	} else if nargs < arity {
+		return m.errorAt(f, fmt.Sprintf("too few arguments for function %s", call.Callee))
+	}
+	return nil
+}
+
+var binaryTokens = map[Opcode]lexer.TokenType{}
+
+func init() {
+	for tok, op := range binaryOps {
+		binaryTokens[op] = tok
+	}
+}
+
+func binary(op Opcode, left, right parser.Value) (parser.Value, error) {
+	// Arithmetic and comparison on numbers is the hot path of most loops.
+	if left.Type == parser.Number && right.Type == parser.Number {
+		switch op {
+		case OpAdd:
+			return parser.Value{Type: parser.Number, Number: left.Number + right.Number}, nil
+		case OpSub:
+			return parser.Value{Type: parser.Number, Number: left.Number - right.Number}, nil
+		case OpMul:
+			return parser.Value{Type: parser.Number, Number: left.Number * right.Number}, nil
+		case OpLess:
+			return parser.Value{Type: parser.Boolean, Boolean: left.Number < right.Number}, nil
+		case OpLessEqual:
+			return parser.Value{Type: parser.Boolean, Boolean: left.Number <= right.Number}, nil
+		case OpGreater:
+			return parser.Value{Type: parser.Boolean, Boolean: left.Number > right.Number}, nil
+		case OpGreaterEqual:
+			return parser.Value{Type: parser.Boolean, Boolean: left.Number >= right.Number}, nil
+		}
+	}
+	return parser.BinaryOp(binaryTokens[op], left, right)
+}
@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/printchard/tiny-lang/lexer"
+	"github.com/printchard/tiny-lang/parser"
+)
+
+// result is what a program printed and the error it stopped with.
+type result struct {
+	out string
+	err string
+}
+
+// compile parses and resolves src for env.
+func compile(t *testing.T, env *parser.Environment, src string) []parser.Statement {
+	t.Helper()
+	file := env.FileSet().AddFile("test.tiny", src)
+	tokens, err := lexer.New(file).Tokenize()
+	if err != nil {
+		t.Fatalf("lexing %q: %v", src, err)
+	}
+	stmts, err := parser.New(file, tokens).Parse()
+	if err != nil {
+		t.Fatalf("parsing %q: %v", src, err)
+	}
+	if diags := parser.ResolveFile(stmts, env, file.Name()); diags.HasErrors() {
+		t.Fatalf("resolving %q: %v", src, diags)
+	}
+	return stmts
+}
+
+// runOn runs src in a new default environment, prepared by setup if it is
+// not nil, on the VM or the tree-walker.
+func runOn(t *testing.T, vm bool, src string, setup func(*parser.Environment)) result {
+	t.Helper()
+	env := parser.NewDefaultEnvironment()
+	var out strings.Builder
+	env.SetIO(parser.IO{Stdout: &out})
+	if setup != nil {
+		setup(env)
+	}
+	stmts := compile(t, env, src)
+	var err error
+	if vm {
+		_, err = New(env).Run(stmts)
+	} else {
+		_, err = parser.Run(stmts, env)
+	}
+	var r result
+	r.out = out.String()
+	if err != nil {
+		r.err = err.Error()
+	}
+	return r
+}
+
+// expectSame runs src on both engines and checks that they print the same
+// and fail with the same error.
+func expectSame(t *testing.T, src string, setup func(*parser.Environment)) result {
+	t.Helper()
+	tree := runOn(t, false, src, setup)
+	vm := runOn(t, true, src, setup)
+	if tree != vm {
+		t.Errorf("running %q:\ntree-walker: %+v\nVM:          %+v", src, tree, vm)
+	}
+	return vm
+}
+
+func TestMatchesTreeWalker(t *testing.T) {
+	for _, src := range []string{
+		`func fib: n { if n < 2 { return n }
+  return fib(n - 1) + fib(n - 2) }
+print(fib(15))`,
+		`let i := 0
+while i < 5 { i = i + 1
+  if i == 2 { continue }
+  print(i) }`,
+		`func counter { let n := 0
+  return func { n = n + 1
+    return n } }
+let c := counter()
+c()
+print(c())`,
+		`let a := 5
+a(1)`,
+		`[1, 2](0)`,
+		`print("a" - 1)`,
+		`let values := [1, 2]
+func f { let keys := 3
+  return keys }
+print(values, f())`,
+		`struct Point { x, y
+  func sum { return self.x + self.y } }
+let p := Point(1, 2)
+func make { return func { return 1 } }
+let f := make
+print(p == Point(1, 2), p == p, p.sum == p.sum, {} == {}, make() == make(), f == make)`,
+		`print == print`,
+		`outer: for i, x in [1, 2, 3] { for c in "ab" {
+    if x == 2 { continue outer }
+    if x == 3 { break outer }
+    print(i, c) } }`,
+		`let fs := {}
+for i in 0..3 { fs[i] = func { return i } }
+print(fs[0](), fs[2]())`,
+		`func f: n { try { if n == 0 { throw "zero" }
+    return 10 / n } catch e { print("caught", e) } finally { print("finally", n) } }
+print(f(2), f(0))
+try { 1 / 0 } catch e { print(e.message, e.line) }`,
+		`struct Counter { n
+  func init: start { self.n = start }
+  func inc { self.n = self.n + 1
+    return self } }
+let c := Counter(1)
+let inc := c.inc
+inc().inc()
+print(c.n, c)`,
+		`let m := {"a": 1}
+m["b"] = 2
+delete(m, "a")
+print(m, keys(m), has(m, "b"))`,
+	} {
+		expectSame(t, src, nil)
+	}
+}
+
+func TestNativeFunctionsSeeGlobals(t *testing.T) {
+	// peek reads the global x and sets y, as a host callback might.
+	setup := func(env *parser.Environment) {
+		env.Define("peek", parser.Value{Type: parser.NativeFunction, NativeFunction: func(env *parser.Environment, _ []parser.Value) (parser.Value, error) {
+			x, ok := env.Get("x")
+			if !ok {
+				return parser.Value{}, errors.New("x is undefined")
+			}
+			env.Set("y", parser.Value{Type: parser.Number, Number: x.Number * 2})
+			return x, nil
+		}})
+	}
+	r := expectSame(t, `let x := 1
+let y := 0
+x = x + 1
+print(peek())
+print(y)`, setup)
+	if want := "2.000000\n4.000000\n"; r.out != want || r.err != "" {
+		t.Errorf("got %+v, want output %q", r, want)
+	}
+}
+
+// runMachine runs src on m and returns the value of its last statement.
+func runMachine(t *testing.T, m *Machine, src string) parser.Value {
+	t.Helper()
+	v, err := m.Run(compile(t, m.env, src))
+	if err != nil {
+		t.Fatalf("running %q: %v", src, err)
+	}
+	return v
+}
+
+func TestGlobalsArePerMachine(t *testing.T) {
+	a := New(parser.NewDefaultEnvironment())
+	b := New(parser.NewDefaultEnvironment())
+	for i := range 100 {
+		runMachine(t, a, fmt.Sprintf("let a%d := %d", i, i))
+	}
+	runMachine(t, b, "let b := 1")
+	if _, ok := b.globals.index["a0"]; ok || len(b.globals.names) != 1 {
+		t.Errorf("b caches the globals %v, want only those of its own programs", b.globals.names)
+	}
+	if len(a.globals.slots) != 0 {
+		t.Errorf("a keeps the globals of %d protos after their runs", len(a.globals.slots))
+	}
+
+	// A function compiled by a uses the globals of the machine running it.
+	runMachine(t, a, "func get { return a1 }")
+	get, _ := a.env.Get("get")
+	b.env.Define("get", get)
+	runMachine(t, b, "let a1 := 42")
+	if v := runMachine(t, b, "get()"); v.Number != 42 {
+		t.Errorf("get() on b = %v, want 42", v.Number)
+	}
+	if v := runMachine(t, a, "get()"); v.Number != 1 {
+		t.Errorf("get() on a = %v, want 1", v.Number)
+	}
+}